@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+/*
+Журнал запросов.
+
+epoll горутина только копирует поля запроса в запись фиксированного размера и без блокировки
+кладет ее в буферизованный канал. Форматирует и пишет отдельная горутина.
+Если она не успевает и канал полон, запись выбрасывается и учитывается в Dropped.
+*/
+
+const (
+	accessLogMaxPath       = 256
+	accessLogDefaultBuffer = 64 * 1024
+	accessLogTimeFormat    = `2006-01-02T15:04:05.000000Z07:00`
+)
+
+type (
+	accessLogEntry struct {
+		time      int64 // UnixNano момента ответа
+		connId    uint64
+		latency   int64 // от первого байта запроса до готового ответа
+		bodyBytes int
+		status    int
+		method    Method
+		pathLen   int // полная длина, в path может быть обрезана
+		path      [accessLogMaxPath]byte
+	}
+
+	AccessLog struct {
+		JSON   bool
+		Sample uint64 // в журнал попадает каждый Sample-й запрос. ответы 5xx пишутся всегда
+
+		entries chan accessLogEntry
+		w       *bufio.Writer
+		done    chan struct{}
+
+		seq     uint64
+		dropped int64
+	}
+)
+
+// bufferSize - сколько записей может ждать форматирования
+func NewAccessLog(w io.Writer, bufferSize int) *AccessLog {
+	if bufferSize <= 0 {
+		bufferSize = accessLogDefaultBuffer
+	}
+
+	a := &AccessLog{
+		Sample:  1,
+		entries: make(chan accessLogEntry, bufferSize),
+		w:       bufio.NewWriterSize(w, 64*1024),
+		done:    make(chan struct{}),
+	}
+
+	go a.writer()
+
+	return a
+}
+
+// вызывается из epoll горутины после buildResponse. не блокируется и не аллоцирует
+func (a *AccessLog) Log(ctx *RequestCtx) {
+	if (a.Sample > 1) && (ctx.ResponseStatus < 500) && (atomic.AddUint64(&a.seq, 1)%a.Sample != 0) {
+		return
+	}
+
+	var entry accessLogEntry
+
+	entry.time = time.Now().UnixNano()
+	entry.connId = ctx.connId
+	if ctx.requestStart > 0 {
+		entry.latency = entry.time - ctx.requestStart
+	}
+	entry.bodyBytes = ctx.responseBodySize()
+	entry.status = ctx.ResponseStatus
+	entry.method = ctx.Method
+	entry.pathLen = len(ctx.Path)
+	copy(entry.path[:], ctx.Path)
+
+	select {
+	case a.entries <- entry:
+	default:
+		atomic.AddInt64(&a.dropped, 1)
+	}
+}
+
+func (a *AccessLog) Dropped() int64 {
+	return atomic.LoadInt64(&a.dropped)
+}
+
+// дописывает оставшиеся записи. Log после Close вызывать нельзя
+func (a *AccessLog) Close() {
+	close(a.entries)
+	<-a.done
+}
+
+func (a *AccessLog) writer() {
+	defer close(a.done)
+
+	buf := make([]byte, 0, 1024)
+
+	for entry := range a.entries {
+		if a.JSON {
+			buf = a.appendJSON(buf[:0], &entry)
+		} else {
+			buf = a.appendText(buf[:0], &entry)
+		}
+
+		if _, err := a.w.Write(buf); err != nil {
+			log.Println(`Access log write fail:`, err)
+		}
+
+		if len(a.entries) == 0 {
+			// очередь разобрана, можно сбросить буфер
+			a.w.Flush()
+		}
+	}
+
+	a.w.Flush()
+}
+
+// 2017-08-25T00:00:00.000000Z 12 GET /users/1 200 97 0.000123
+func (a *AccessLog) appendText(buf []byte, entry *accessLogEntry) []byte {
+	buf = time.Unix(0, entry.time).UTC().AppendFormat(buf, accessLogTimeFormat)
+	buf = append(buf, ' ')
+	buf = strconv.AppendUint(buf, entry.connId, 10)
+	buf = append(buf, ' ')
+	buf = append(buf, entry.methodName()...)
+	buf = append(buf, ' ')
+	if path := entry.pathBytes(); len(path) > 0 {
+		buf = append(buf, path...)
+	} else {
+		buf = append(buf, '-')
+	}
+	buf = append(buf, ' ')
+	buf = strconv.AppendInt(buf, int64(entry.status), 10)
+	buf = append(buf, ' ')
+	buf = strconv.AppendInt(buf, int64(entry.bodyBytes), 10)
+	buf = append(buf, ' ')
+	buf = strconv.AppendFloat(buf, time.Duration(entry.latency).Seconds(), 'f', 6, 64)
+	buf = append(buf, '\n')
+	return buf
+}
+
+// {"time":"...","conn":12,"method":"GET","path":"/users/1","status":200,"bytes":97,"latency":0.000123}
+func (a *AccessLog) appendJSON(buf []byte, entry *accessLogEntry) []byte {
+	buf = append(buf, `{"time":"`...)
+	buf = time.Unix(0, entry.time).UTC().AppendFormat(buf, accessLogTimeFormat)
+	buf = append(buf, `","conn":`...)
+	buf = strconv.AppendUint(buf, entry.connId, 10)
+	buf = append(buf, `,"method":"`...)
+	buf = append(buf, entry.methodName()...)
+	buf = append(buf, `","path":"`...)
+	buf = accessLogAppendJSONString(buf, entry.pathBytes())
+	buf = append(buf, `","status":`...)
+	buf = strconv.AppendInt(buf, int64(entry.status), 10)
+	buf = append(buf, `,"bytes":`...)
+	buf = strconv.AppendInt(buf, int64(entry.bodyBytes), 10)
+	buf = append(buf, `,"latency":`...)
+	buf = strconv.AppendFloat(buf, time.Duration(entry.latency).Seconds(), 'f', 6, 64)
+	buf = append(buf, "}\n"...)
+	return buf
+}
+
+func (entry *accessLogEntry) methodName() string {
+	if (entry.method >= 0) && (entry.method < MethodsCount) {
+		return methodNames[entry.method]
+	}
+	return `-`
+}
+
+func (entry *accessLogEntry) pathBytes() []byte {
+	if entry.pathLen > accessLogMaxPath {
+		return entry.path[:]
+	}
+	return entry.path[:entry.pathLen]
+}
+
+// путь приходит от клиента как есть, поэтому кавычки и управляющие символы надо экранировать
+func accessLogAppendJSONString(buf, s []byte) []byte {
+	const hex = `0123456789abcdef`
+
+	for _, ch := range s {
+		switch {
+		case (ch == '"') || (ch == '\\'):
+			buf = append(buf, '\\', ch)
+		case ch < 0x20:
+			buf = append(buf, '\\', 'u', '0', '0', hex[ch>>4], hex[ch&0xF])
+		default:
+			buf = append(buf, ch)
+		}
+	}
+
+	return buf
+}
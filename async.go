@@ -0,0 +1,109 @@
+package main
+
+import (
+	"log"
+	"runtime/debug"
+	"sync"
+)
+
+/*
+Долгая работа в обработчике без остановки epoll горутины.
+
+Обработчик вызывает ctx.Async(work, finish) и сразу возвращается. work выполняется в отдельной
+горутине и ctx не трогает. После нее epoll горутина (разбуженная через eventfd слушателя)
+вызывает finish, который заполняет ответ, и дальше ответ уходит обычным образом.
+
+Пока работа идет, соединение не читается и таймеры на нем не взводятся. Если соединение успело
+закрыться, finish не вызывается.
+*/
+
+type (
+	httpAsync struct {
+		ctx    *RequestCtx
+		connId uint64 // ctx мог уже уйти под другое соединение
+		finish func(ctx *RequestCtx)
+		pipe   *streamPipe // не nil - в pipe появились данные для StreamAsync, finish не используется
+	}
+
+	// завершенные work, ждущие epoll горутину
+	httpAsyncQueue struct {
+		mu     sync.Mutex
+		ready  []httpAsync
+		closed bool // epoll горутина завершилась, будить некого
+	}
+)
+
+func (c *RequestCtx) Async(work func(), finish func(ctx *RequestCtx)) {
+	c.async = true
+
+	lp, done := c.loop, httpAsync{ctx: c, connId: c.connId, finish: finish}
+
+	go func() {
+		defer func() {
+			if err := recover(); err != nil {
+				log.Printf("async panic: %v\n%s", err, debug.Stack())
+			}
+			lp.asyncDone(done)
+		}()
+
+		work()
+	}()
+}
+
+// вызывается из горутины work
+func (lp *httpLoop) asyncDone(done httpAsync) {
+	q := &lp.async
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return
+	}
+	q.ready = append(q.ready, done)
+
+	if err := socketEventFdNotify(lp.l.wakeFd); err != nil {
+		log.Println(`eventfd write: `, err)
+	}
+}
+
+// ответы на запросы, чья work завершилась. вызывается из epoll горутины
+func (lp *httpLoop) asyncFinish() {
+	q := &lp.async
+
+	q.mu.Lock()
+	ready := q.ready
+	q.ready = nil
+	q.mu.Unlock()
+
+	for _, done := range ready {
+		ctx := done.ctx
+		if (lp.activeCtx[ctx.fd] != ctx) || (ctx.connId != done.connId) || !ctx.async {
+			// соединение закрылось, пока шла работа
+			continue
+		}
+
+		if done.pipe != nil {
+			if ctx.pipe == done.pipe {
+				lp.streamPump(ctx)
+			}
+			continue
+		}
+
+		ctx.async = false
+		done.finish(ctx)
+
+		if lp.respond(ctx) {
+			// следующий запрос мог прийти, пока шла работа
+			lp.serve(ctx)
+		}
+	}
+}
+
+// epoll горутина завершается: запоздавшие work больше не будят ее eventfd
+func (lp *httpLoop) asyncClose() {
+	lp.async.mu.Lock()
+	lp.async.closed = true
+	lp.async.ready = nil
+	lp.async.mu.Unlock()
+}
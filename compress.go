@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+)
+
+/*
+Сжатие ответов по Accept-Encoding: gzip и deflate (по HTTP это zlib обертка, RFC 7230 4.2.2).
+
+Обычный ответ сжимается целиком перед buildResponse, так что Content-Length считается уже
+по сжатому телу. Потоковый ответ (StartStream) сжимается на лету, каждый Write/Flush
+превращается в chunk со сжатыми данными.
+
+Тело запроса с Content-Encoding: gzip или deflate распаковывается до вызова обработчика
+в буфер epoll горутины. Размер распакованного ограничен HTTPServer.MaxBodySize (413),
+неизвестная кодировка - 415, битые данные - 400.
+
+Компрессоры живут в epoll горутине и переиспользуются, блокировки не нужны: все они
+используются только из нее. Для обычных ответов и тел запросов хватает одного набора на горутину,
+потому что сжатие и распаковка заканчиваются внутри обработки запроса. Потоковый ответ сжимается
+кусками, пока обрабатываются другие запросы горутины (StreamAsync), поэтому получает свой
+компрессор на время ответа из небольшого запаса горутины.
+*/
+
+type (
+	CompressOptions struct {
+		MinSize int // тела короче не сжимаются. на потоковые ответы не влияет
+		Level   int // gzip.BestSpeed ... gzip.BestCompression или gzip.DefaultCompression
+	}
+
+	contentEncoding int
+
+	// компрессор потокового ответа. Flush выталкивает накопленное в очередной chunk
+	streamEncoder interface {
+		io.WriteCloser
+		Flush() error
+	}
+
+	// компрессоры одной epoll горутины, создаются при первом использовании
+	httpCompressor struct {
+		gzip *gzip.Writer
+		zlib *zlib.Writer
+		out  byteSliceWriter // сжатое тело обычного ответа
+
+		// запас компрессоров для потоковых ответов
+		streamGzip []*gzip.Writer
+		streamZlib []*zlib.Writer
+
+		gunzip *gzip.Reader
+		unzlib io.ReadCloser
+		src    bytes.Reader // сжатое тело запроса
+		body   []byte       // распакованное тело запроса
+	}
+
+	byteSliceWriter struct {
+		buf []byte
+	}
+
+	streamChunkWriter struct {
+		ctx *RequestCtx
+	}
+)
+
+const (
+	// сколько компрессоров потоковых ответов горутина держит про запас. каждый под мегабайт
+	compressStreamKeep = 4
+)
+
+const (
+	encodingIdentity = contentEncoding(iota)
+	encodingGzip
+	encodingDeflate
+)
+
+var (
+	contentEncodingNames = [...][]byte{
+		encodingIdentity: []byte(`identity`),
+		encodingGzip:     []byte(`gzip`),
+		encodingDeflate:  []byte(`deflate`),
+	}
+)
+
+func (w *byteSliceWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	return len(p), nil
+}
+
+func (w *streamChunkWriter) Write(p []byte) (int, error) {
+	return w.ctx.writeChunk(p)
+}
+
+// компрессор, пишущий в w. предыдущее использование забывается
+func (c *httpCompressor) encoder(enc contentEncoding, level int, w io.Writer) streamEncoder {
+	if enc == encodingGzip {
+		if c.gzip == nil {
+			// уровень проверен при старте в compressCheckArgs
+			c.gzip, _ = gzip.NewWriterLevel(w, level)
+		} else {
+			c.gzip.Reset(w)
+		}
+		return c.gzip
+	}
+
+	if c.zlib == nil {
+		c.zlib, _ = zlib.NewWriterLevel(w, level)
+	} else {
+		c.zlib.Reset(w)
+	}
+	return c.zlib
+}
+
+// распаковщик тела запроса из c.src
+func (c *httpCompressor) decoder(enc contentEncoding) (io.Reader, error) {
+	if enc == encodingGzip {
+		if c.gunzip == nil {
+			r, err := gzip.NewReader(&c.src)
+			if err != nil {
+				return nil, err
+			}
+			c.gunzip = r
+			return r, nil
+		}
+		return c.gunzip, c.gunzip.Reset(&c.src)
+	}
+
+	if c.unzlib == nil {
+		r, err := zlib.NewReader(&c.src)
+		if err != nil {
+			return nil, err
+		}
+		c.unzlib = r
+		return r, nil
+	}
+	return c.unzlib, c.unzlib.(zlib.Resetter).Reset(&c.src, nil)
+}
+
+// распаковка ctx.Body по Content-Encoding запроса. 0 - можно звать обработчик, иначе код ответа
+func (lp *httpLoop) decompressRequest(ctx *RequestCtx) int {
+	encoding := ctx.RequestHeaders.Peek(strContentEncoding)
+	if encoding == nil {
+		return 0
+	}
+
+	var enc contentEncoding
+	switch {
+	case bytes.EqualFold(encoding, contentEncodingNames[encodingIdentity]):
+		enc = encodingIdentity
+	case bytes.EqualFold(encoding, contentEncodingNames[encodingGzip]):
+		enc = encodingGzip
+	case bytes.EqualFold(encoding, contentEncodingNames[encodingDeflate]):
+		enc = encodingDeflate
+	default:
+		return 415
+	}
+
+	// обработчик получает уже обычное тело
+	ctx.RequestHeaders.Del(strContentEncoding)
+
+	if (enc == encodingIdentity) || (len(ctx.Body) == 0) {
+		return 0
+	}
+
+	c := &lp.compress
+	c.src.Reset(ctx.Body)
+	r, err := c.decoder(enc)
+	if err != nil {
+		return 400
+	}
+
+	limit := lp.s.maxBodySize()
+
+	buf := c.body
+	if (cap(buf) == 0) || (cap(buf) > maxKeptBufSize) {
+		buf = make([]byte, 0, inputBufSize)
+	}
+	buf = buf[:0]
+
+	for {
+		if len(buf) == cap(buf) {
+			buf = append(buf, 0)[:len(buf)]
+		}
+
+		n, err := r.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+
+		if len(buf) > limit {
+			// zip бомбу дальше не распаковываем
+			c.body = buf
+			return 413
+		} else if err == io.EOF {
+			break
+		} else if err != nil {
+			c.body = buf
+			return 400
+		}
+	}
+
+	// буфер принадлежит горутине, обработчик выполняется до следующего запроса
+	c.body = buf
+	ctx.Body = buf
+	return 0
+}
+
+// выбор кодировки для ответа. заодно выставляет Vary и Content-Encoding.
+// size - длина тела, -1 для потокового ответа
+func (lp *httpLoop) negotiateCompression(ctx *RequestCtx, size int) contentEncoding {
+	opts := lp.s.Compression
+	if (opts == nil) || statusBodiless(ctx.ResponseStatus) || ctx.ResponseHeaders.Has(strContentEncoding) {
+		return encodingIdentity
+	} else if (size >= 0) && (size < opts.MinSize) {
+		return encodingIdentity
+	} else if !compressibleContentType(ctx.ResponseHeaders.Peek(strContentType)) {
+		return encodingIdentity
+	}
+
+	// ответ на этот же запрос без Accept-Encoding был бы другим, кешам это нужно знать
+	ctx.ResponseHeaders.Add(strVary, strAcceptEncoding)
+
+	enc := negotiateEncoding(ctx.RequestHeaders.Peek(strAcceptEncoding))
+	if enc != encodingIdentity {
+		ctx.ResponseHeaders.Set(strContentEncoding, contentEncodingNames[enc])
+
+		// сжатое тело побайтно другое, так что строгий ETag становится слабым (как в nginx)
+		if etag := ctx.ResponseHeaders.Peek(strETag); (etag != nil) && !bytes.HasPrefix(etag, strWeakETagPrefix) {
+			var tmp [64]byte
+			ctx.ResponseHeaders.Set(strETag, append(append(tmp[:0], strWeakETagPrefix...), etag...))
+		}
+	}
+	return enc
+}
+
+// сжатие ctx.ResponseBody перед buildResponse
+func (lp *httpLoop) compressResponse(ctx *RequestCtx) {
+	enc := lp.negotiateCompression(ctx, len(ctx.ResponseBody))
+	if enc == encodingIdentity {
+		return
+	}
+
+	c := &lp.compress
+	if cap(c.out.buf) > maxKeptBufSize {
+		c.out.buf = nil
+	}
+	c.out.buf = c.out.buf[:0]
+
+	w := c.encoder(enc, lp.s.Compression.Level, &c.out)
+	w.Write(ctx.ResponseBody)
+	w.Close()
+
+	// до buildResponse буфер никто больше не тронет
+	ctx.ResponseBody = c.out.buf
+}
+
+// компрессор для потокового ответа или nil, если сжимать не нужно
+func (lp *httpLoop) compressStream(ctx *RequestCtx) streamEncoder {
+	enc := lp.negotiateCompression(ctx, -1)
+	if enc == encodingIdentity {
+		return nil
+	}
+
+	c, level := &lp.compress, lp.s.Compression.Level
+	ctx.chunkWriter.ctx = ctx
+	w := &ctx.chunkWriter
+
+	if enc == encodingGzip {
+		if n := len(c.streamGzip); n > 0 {
+			gz := c.streamGzip[n-1]
+			c.streamGzip = c.streamGzip[:n-1]
+			gz.Reset(w)
+			return gz
+		}
+		gz, _ := gzip.NewWriterLevel(w, level)
+		return gz
+	}
+
+	if n := len(c.streamZlib); n > 0 {
+		zw := c.streamZlib[n-1]
+		c.streamZlib = c.streamZlib[:n-1]
+		zw.Reset(w)
+		return zw
+	}
+	zw, _ := zlib.NewWriterLevel(w, level)
+	return zw
+}
+
+// возврат компрессора потокового ответа в запас после Close
+func (lp *httpLoop) releaseStreamEncoder(encoder streamEncoder) {
+	c := &lp.compress
+
+	switch encoder := encoder.(type) {
+	case *gzip.Writer:
+		if len(c.streamGzip) < compressStreamKeep {
+			c.streamGzip = append(c.streamGzip, encoder)
+		}
+	case *zlib.Writer:
+		if len(c.streamZlib) < compressStreamKeep {
+			c.streamZlib = append(c.streamZlib, encoder)
+		}
+	}
+}
+
+// разбор Accept-Encoding с учетом q. при равных весах gzip предпочтительнее
+func negotiateEncoding(accept []byte) contentEncoding {
+	gzipQ, deflateQ, anyQ := -1, -1, -1
+
+	for len(accept) > 0 {
+		var item []byte
+		if idx := bytes.IndexByte(accept, ','); idx == -1 {
+			item, accept = accept, nil
+		} else {
+			item, accept = accept[:idx], accept[idx+1:]
+		}
+
+		name, q := item, 1000
+		if idx := bytes.IndexByte(item, ';'); idx != -1 {
+			name = item[:idx]
+			q = parseQValue(item[idx+1:])
+		}
+		name = bytes.TrimSpace(name)
+
+		switch {
+		case bytes.EqualFold(name, contentEncodingNames[encodingGzip]):
+			gzipQ = q
+		case bytes.EqualFold(name, contentEncodingNames[encodingDeflate]):
+			deflateQ = q
+		case bytes.Equal(name, strAsterisk):
+			anyQ = q
+		}
+	}
+
+	// * относится ко всем не перечисленным явно
+	if gzipQ == -1 {
+		gzipQ = anyQ
+	}
+	if deflateQ == -1 {
+		deflateQ = anyQ
+	}
+
+	if (gzipQ > 0) && (gzipQ >= deflateQ) {
+		return encodingGzip
+	} else if deflateQ > 0 {
+		return encodingDeflate
+	}
+	return encodingIdentity
+}
+
+// " q=0.5" -> 500. кривые значения считаются за 0
+func parseQValue(param []byte) int {
+	param = bytes.TrimSpace(param)
+	if (len(param) < 3) || ((param[0] != 'q') && (param[0] != 'Q')) || (param[1] != '=') {
+		return 0
+	}
+	param = param[2:]
+
+	if param[0] == '1' {
+		return 1000
+	} else if param[0] != '0' {
+		return 0
+	}
+
+	q, mul := 0, 100
+	if (len(param) > 1) && (param[1] == '.') {
+		for _, c := range param[2:] {
+			if (c < '0') || (c > '9') || (mul == 0) {
+				break
+			}
+			q += int(c-'0') * mul
+			mul /= 10
+		}
+	}
+	return q
+}
+
+// json и текст сжимаются хорошо, zip и бинарные профили - нет
+func compressibleContentType(contentType []byte) bool {
+	if contentType == nil {
+		// по умолчанию application/json
+		return true
+	}
+	return bytes.HasPrefix(contentType, strTextPrefix) || (bytes.Index(contentType, strJSON) != -1)
+}
+
+func compressCheckArgs(level int) error {
+	_, err := gzip.NewWriterLevel(nil, level)
+	return err
+}
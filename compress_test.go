@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		accept string
+		enc    contentEncoding
+	}{
+		{accept: ``, enc: encodingIdentity},
+		{accept: `gzip`, enc: encodingGzip},
+		{accept: `GZIP`, enc: encodingGzip},
+		{accept: `deflate`, enc: encodingDeflate},
+		{accept: `br`, enc: encodingIdentity},
+		{accept: `gzip;q=0`, enc: encodingIdentity},
+		{accept: `gzip;q=0, deflate`, enc: encodingDeflate},
+		{accept: `gzip; q=0.000`, enc: encodingIdentity},
+		{accept: `*`, enc: encodingGzip},
+		{accept: `*;q=0`, enc: encodingIdentity},
+		{accept: `gzip;q=0, *`, enc: encodingDeflate},
+		{accept: `deflate;q=0, *;q=0.1`, enc: encodingGzip},
+		// при равных весах gzip
+		{accept: `deflate, gzip`, enc: encodingGzip},
+		{accept: `deflate;q=0.5, gzip;q=0.5`, enc: encodingGzip},
+		{accept: `gzip;q=0.4, deflate;q=0.5`, enc: encodingDeflate},
+		{accept: `gzip;q=1.0, deflate;q=0.9`, enc: encodingGzip},
+		// кривой q считается за 0
+		{accept: `gzip;q=x, deflate;q=0.1`, enc: encodingDeflate},
+		{accept: ` gzip ;q=0.8 , identity`, enc: encodingGzip},
+	}
+
+	for _, test := range tests {
+		if enc := negotiateEncoding([]byte(test.accept)); enc != test.enc {
+			t.Errorf(`negotiateEncoding(%q) = %s, want %s`, test.accept, contentEncodingNames[enc], contentEncodingNames[test.enc])
+		}
+	}
+}
+
+// MinSize, Vary и тип содержимого при сжатии обычного ответа
+func TestCompressResponse(t *testing.T) {
+	const minSize = 100
+	lp := &httpLoop{s: &HTTPServer{Compression: &CompressOptions{MinSize: minSize, Level: gzip.BestSpeed}}}
+
+	body := bytes.Repeat([]byte(`{"id":1}`), minSize)
+
+	tests := []struct {
+		name        string
+		accept      string
+		contentType string
+		body        []byte
+		enc         string // ожидаемый Content-Encoding, пусто - без сжатия
+		vary        bool
+	}{
+		{name: `gzip`, accept: `gzip`, body: body, enc: `gzip`, vary: true},
+		{name: `deflate`, accept: `deflate`, body: body, enc: `deflate`, vary: true},
+		// сжатия нет, но с другим Accept-Encoding ответ был бы сжат
+		{name: `no accept`, body: body, vary: true},
+		{name: `below MinSize`, accept: `gzip`, body: body[:minSize-1]},
+		{name: `zip`, accept: `gzip`, contentType: `application/zip`, body: body},
+		{name: `text`, accept: `gzip`, contentType: `text/plain`, body: body, enc: `gzip`, vary: true},
+	}
+
+	for _, test := range tests {
+		ctx := &RequestCtx{}
+		ctx.Reset()
+		ctx.loop = lp
+		ctx.ResponseStatus = 200
+		if test.accept != `` {
+			ctx.RequestHeaders.Set(strAcceptEncoding, []byte(test.accept))
+		}
+		if test.contentType != `` {
+			ctx.ResponseHeaders.Set(strContentType, []byte(test.contentType))
+		}
+		ctx.ResponseBody = test.body
+
+		lp.compressResponse(ctx)
+
+		if enc := string(ctx.ResponseHeaders.Peek(strContentEncoding)); enc != test.enc {
+			t.Errorf(`%s: Content-Encoding %q, want %q`, test.name, enc, test.enc)
+		}
+		if vary := string(ctx.ResponseHeaders.Peek(strVary)); (vary == string(strAcceptEncoding)) != test.vary {
+			t.Errorf(`%s: Vary %q`, test.name, vary)
+		}
+		if (test.enc == ``) && !bytes.Equal(ctx.ResponseBody, test.body) {
+			t.Errorf(`%s: body changed without compression`, test.name)
+		}
+	}
+}
+
+// сжатый ответ целиком через serve: заголовки, Content-Length по сжатому телу и распаковка клиентом
+func TestServeCompressedResponse(t *testing.T) {
+	body := strings.Repeat(`{"id":1,"email":"a@b.c"},`, 200)
+
+	s := &HTTPServer{Compression: &CompressOptions{Level: gzip.DefaultCompression}, Handler: func(ctx *RequestCtx) {
+		ctx.ResponseBody = []byte(body)
+	}}
+	lp, ctx, client, read := serveTestConn(t, s)
+
+	syscall.Write(client, []byte("GET /users/1 HTTP/1.1\r\nAccept-Encoding: gzip\r\n\r\n"))
+	lp.serve(ctx)
+	response := read()
+
+	idx := strings.Index(response, "\r\n\r\n")
+	if idx == -1 {
+		t.Fatalf(`no headers end in %q`, response)
+	}
+	headers, compressed := response[:idx+2], response[idx+4:]
+
+	for _, header := range []string{"HTTP/1.1 200 OK\r\n", "\r\nContent-Encoding: gzip\r\n", "\r\nVary: Accept-Encoding\r\n"} {
+		if !strings.Contains(headers, header) {
+			t.Errorf(`no %q in %q`, header, headers)
+		}
+	}
+	if !strings.Contains(headers, "\r\nContent-Length: "+strconv.Itoa(len(compressed))+"\r\n") {
+		t.Errorf(`Content-Length does not match %d compressed bytes: %q`, len(compressed), headers)
+	}
+
+	r, err := gzip.NewReader(strings.NewReader(compressed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain, err := io.ReadAll(r); err != nil {
+		t.Fatal(err)
+	} else if string(plain) != body {
+		t.Errorf(`decoded body of %d bytes, want %d`, len(plain), len(body))
+	}
+}
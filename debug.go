@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"runtime"
+	"runtime/pprof"
+	"time"
+)
+
+/*
+Профили и состояние рантайма по запросу:
+	GET /debug/pprof/                    список профилей
+	GET /debug/pprof/profile?seconds=N   CPU профиль за N секунд
+	GET /debug/pprof/<name>?debug=N      heap, goroutine, mutex, block, allocs, threadcreate
+	GET /debug/memstats                  runtime.MemStats в json
+
+Отдается в формате net/http/pprof, так что годится для go tool pprof http://host:port/debug/pprof/heap.
+
+Обработчики работают синхронно в epoll горутине, кроме CPU профиля: его N секунд ждет отдельная горутина (ctx.Async).
+Все это живет на отдельном -admin-port со своим HTTPServer на один слушатель.
+На основном порту - только если админского порта нет, а -auth-token задан.
+*/
+
+const (
+	debugCPUProfileDefault = 30 * time.Second
+	debugCPUProfileMax     = 5 * time.Minute
+)
+
+var (
+	adminServer HTTPServer
+	adminRouter Router
+)
+
+func registerAdminRoutes() {
+	registerDebugRoutes(&adminRouter)
+	registerServiceRoutes(&adminRouter)
+	registerAdminDataRoutes(&adminRouter)
+}
+
+func registerDebugRoutes(r *Router) {
+	r.Handle(MethodGET, `/debug/pprof/`, metricsRouteDebug, reqDebugPprofIndex)
+	r.Handle(MethodGET, `/debug/pprof/profile`, metricsRouteDebug, reqDebugCPUProfile)
+	r.Handle(MethodGET, `/debug/pprof/{name}`, metricsRouteDebug, reqDebugPprof)
+	r.Handle(MethodGET, `/debug/memstats`, metricsRouteDebug, reqDebugMemStats)
+}
+
+// обработчик для -admin-port
+func adminRequestHandler(ctx *RequestCtx) {
+	req := requestParamsPool.Get().(*RequestParams)
+
+	if !parseRequest(ctx, req) {
+		ctx.ResponseStatus = 400
+	} else {
+		adminRouter.Dispatch(ctx, req)
+	}
+
+	requestParamsPool.Put(req)
+}
+
+func reqDebugMemStats(ctx *RequestCtx, req *RequestParams) {
+	// GET /debug/memstats
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+	json.NewEncoder(ctx).Encode(&memStats)
+}
+
+func reqDebugPprof(ctx *RequestCtx, req *RequestParams) {
+	// GET /debug/pprof/<name>
+	profile := pprof.Lookup(string(req.Param(`name`)))
+	if profile == nil {
+		ctx.ResponseStatus = 404
+		return
+	}
+
+	if req.debug > 0 {
+		ctx.SetContentType(contentTypeText)
+	} else {
+		ctx.SetContentType(contentTypeBinary)
+	}
+
+	if err := profile.WriteTo(ctx, int(req.debug)); err != nil {
+		ctx.ResponseStatus = 500
+		ctx.ResponseBody = nil
+	}
+}
+
+func reqDebugPprofIndex(ctx *RequestCtx, req *RequestParams) {
+	// GET /debug/pprof/
+	buf := ctx.UserBuf[:0]
+
+	buf = append(buf, "profile\n"...)
+	for _, profile := range pprof.Profiles() {
+		buf = append(buf, profile.Name()...)
+		buf = append(buf, '\n')
+	}
+
+	ctx.SetContentType(contentTypeText)
+	ctx.ResponseBody = buf
+}
+
+func reqDebugCPUProfile(ctx *RequestCtx, req *RequestParams) {
+	// GET /debug/pprof/profile?seconds=N
+	duration := time.Duration(req.seconds) * time.Second
+	if duration <= 0 {
+		duration = debugCPUProfileDefault
+	} else if duration > debugCPUProfileMax {
+		duration = debugCPUProfileMax
+	}
+
+	// профиль копится отдельно: ctx до конца работы трогать нельзя
+	profile := new(bytes.Buffer)
+	if err := pprof.StartCPUProfile(profile); err != nil {
+		// уже снимается: другим запросом или через -pprof
+		ctx.ResponseStatus = 409
+		return
+	}
+
+	ctx.Async(func() {
+		time.Sleep(duration)
+		pprof.StopCPUProfile()
+	}, func(ctx *RequestCtx) {
+		ctx.SetContentType(contentTypeBinary)
+		ctx.ResponseBody = profile.Bytes()
+	})
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"strconv"
+)
+
+const (
+	etagMaxLen = 48
+)
+
+// "<epoch>-<version>". счетчик версий начинается заново при каждом запуске,
+// так что без эпохи ETag, выданный до перезапуска, мог бы совпасть с версией другого объекта
+func appendETag(buf []byte, version uint64) []byte {
+	buf = append(buf, '"')
+	buf = strconv.AppendUint(buf, dbEpoch, 36)
+	buf = append(buf, '-')
+	buf = strconv.AppendUint(buf, version, 10)
+	buf = append(buf, '"')
+	return buf
+}
+
+// проверка значения If-Match/If-None-Match: "*" или список ETag через запятую.
+// strong - строгое сравнение для If-Match: слабые W/ теги не совпадают ни с чем
+func etagMatch(header []byte, version uint64, strong bool) bool {
+	var tmp [etagMaxLen]byte
+	etag := appendETag(tmp[:0], version)
+
+	for len(header) > 0 {
+		var item []byte
+		if idx := bytes.IndexByte(header, ','); idx == -1 {
+			item, header = header, nil
+		} else {
+			item, header = header[:idx], header[idx+1:]
+		}
+
+		item = bytes.TrimSpace(item)
+		if len(item) == 1 && item[0] == '*' {
+			return true
+		}
+		if bytes.HasPrefix(item, strWeakETagPrefix) {
+			if strong {
+				continue
+			}
+			// слабое сравнение: W/"1" == "1"
+			item = item[len(strWeakETagPrefix):]
+		}
+
+		if bytes.Equal(item, etag) {
+			return true
+		}
+	}
+
+	return false
+}
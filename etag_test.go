@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestETagMatch(t *testing.T) {
+	etag := string(appendETag(nil, 3))
+	other := string(appendETag(nil, 4))
+
+	tests := []struct {
+		header string
+		strong bool
+		match  bool
+	}{
+		{header: etag, strong: false, match: true},
+		{header: etag, strong: true, match: true},
+		{header: `W/` + etag, strong: false, match: true},
+		{header: `W/` + etag, strong: true, match: false},
+		{header: `*`, strong: true, match: true},
+		{header: other, strong: false, match: false},
+		{header: other + `, ` + etag, strong: true, match: true},
+		{header: other + `,W/` + etag, strong: true, match: false},
+		{header: ` ` + etag + ` `, strong: true, match: true},
+		{header: `"3"`, strong: false, match: false}, // версия из прошлого запуска
+		{header: ``, strong: false, match: false},
+	}
+
+	for _, test := range tests {
+		if match := etagMatch([]byte(test.header), 3, test.strong); match != test.match {
+			t.Errorf(`etagMatch(%q, strong=%v) = %v, want %v`, test.header, test.strong, match, test.match)
+		}
+	}
+}
+
+func TestETagEpoch(t *testing.T) {
+	saved := dbEpoch
+	defer func() { dbEpoch = saved }()
+
+	before := string(appendETag(nil, 1))
+	dbEpoch++
+	if after := string(appendETag(nil, 1)); before == after {
+		t.Errorf(`same ETag %s for different epochs`, before)
+	}
+	if len(appendETag(nil, 1<<64-1)) > etagMaxLen {
+		t.Error(`ETag longer than etagMaxLen`)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"archive/zip"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	exportChunkSize = 10 * 1000 // записей на один users_N.json / locations_N.json / visits_N.json
+)
+
+var (
+	// снимки в -snapshot после фаз и при остановке пишутся по одному
+	snapshotLock sync.Mutex
+)
+
+// выгрузка текущего состояния в формате исходного data.zip (тот, что читает loadDB).
+// dbLock.RLock держится до конца записи, так что годится, когда писателей нет (-dump, остановка)
+func exportDB(w io.Writer) error {
+	zw := zip.NewWriter(w)
+
+	dbLock.RLock()
+	err := exportEntities(func(name string, data []byte) error {
+		return exportZipFile(zw, name, data)
+	})
+	dbLock.RUnlock()
+
+	if err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func exportDBToFile(filePath string) error {
+	return exportToFile(filePath, exportDB)
+}
+
+// копия базы в виде json файлов будущего архива. под dbLock.RLock только сериализация,
+// сжатие и запись потом идут без блокировки и писателей не держат
+func exportDBFiles() []exportFile {
+	var files []exportFile
+
+	dbLock.RLock()
+	exportEntities(func(name string, data []byte) error {
+		files = append(files, exportFile{name: name, data: append([]byte(nil), data...)})
+		return nil
+	})
+	dbLock.RUnlock()
+
+	return files
+}
+
+// архив из готовой копии exportDBFiles
+func exportWriteZip(w io.Writer, files []exportFile) error {
+	zw := zip.NewWriter(w)
+	for i := range files {
+		if err := exportZipFile(zw, files[i].name, files[i].data); err != nil {
+			return err
+		}
+		// копия сущностей этого файла больше не нужна, пусть память освобождается по ходу записи
+		files[i].data = nil
+	}
+	return zw.Close()
+}
+
+// как exportDBToFile, но с копией: для снимков на ходу
+func exportDBCopyToFile(filePath string) error {
+	files := exportDBFiles()
+	return exportToFile(filePath, func(w io.Writer) error {
+		return exportWriteZip(w, files)
+	})
+}
+
+// архив пишется рядом во временный файл и только целиком подменяет старый: падение или
+// истекший таймаут остановки посреди записи не должны портить снимок, с которого потом стартуем
+func exportToFile(filePath string, export func(w io.Writer) error) error {
+	tmpPath := filePath + `.tmp`
+
+	fd, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+
+	if err = export(fd); err == nil {
+		err = fd.Sync()
+	}
+	if closeErr := fd.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, filePath)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	// сам rename тоже должен пережить падение
+	if dir, err := os.Open(filepath.Dir(filePath)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
+	return nil
+}
+
+// все сущности файлами по exportChunkSize записей. вызывать под dbLock.RLock
+func exportEntities(put func(name string, data []byte) error) error {
+	chunk := exportChunk{put: put, prefix: `locations_`, entity: strLocations}
+	indexLocation.ForEach(func(location *Location) bool {
+		chunk.buf = location.Serialize(chunk.next())
+		return chunk.err == nil
+	})
+	if err := chunk.flush(); err != nil {
+		return err
+	}
+
+	chunk = exportChunk{put: put, prefix: `users_`, entity: strUsers}
+	indexUser.ForEach(func(user *User) bool {
+		chunk.buf = user.Serialize(chunk.next())
+		return chunk.err == nil
+	})
+	if err := chunk.flush(); err != nil {
+		return err
+	}
+
+	chunk = exportChunk{put: put, prefix: `visits_`, entity: strVisits}
+	indexVisit.ForEach(func(visit *Visit) bool {
+		chunk.buf = visit.Serialize(chunk.next())
+		return chunk.err == nil
+	})
+	return chunk.flush()
+}
+
+func exportZipFile(zw *zip.Writer, name string, data []byte) error {
+	fw, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = fw.Write(data)
+	return err
+}
+
+type exportFile struct {
+	name string
+	data []byte
+}
+
+// накапливает записи одного типа и сбрасывает их в архив файлами по exportChunkSize штук
+type exportChunk struct {
+	put    func(name string, data []byte) error
+	prefix string
+	entity []byte
+
+	num   int
+	items int
+	buf   []byte
+	err   error
+}
+
+// подготавливает buf к дописыванию очередной записи
+func (c *exportChunk) next() []byte {
+	if c.items >= exportChunkSize {
+		c.err = c.flush()
+	}
+
+	if c.items == 0 {
+		c.buf = append(c.buf[:0], `{"`...)
+		c.buf = append(c.buf, c.entity...)
+		c.buf = append(c.buf, `": [`...)
+	} else {
+		c.buf = append(c.buf, ',')
+	}
+	c.items++
+
+	return c.buf
+}
+
+func (c *exportChunk) flush() error {
+	if c.err != nil {
+		return c.err
+	} else if c.items == 0 {
+		// пустой массив ParseData не примет, поэтому пустые файлы не пишем
+		return nil
+	}
+
+	c.num++
+	c.items = 0
+	c.buf = append(c.buf, `]}`...)
+
+	return c.put(c.prefix+strconv.Itoa(c.num)+`.json`, c.buf)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// оборванная запись не трогает прежний снимок
+func TestExportToFileAtomic(t *testing.T) {
+	path := filepath.Join(t.TempDir(), `snapshot.zip`)
+
+	write := func(data string, fail bool) error {
+		return exportToFile(path, func(w io.Writer) error {
+			if _, err := io.WriteString(w, data); err != nil {
+				return err
+			}
+			if fail {
+				return errors.New(`crash`)
+			}
+			return nil
+		})
+	}
+
+	if err := write(`old`, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := write(`new, half-written`, true); err == nil {
+		t.Fatal(`no error from failed export`)
+	}
+
+	if data, err := os.ReadFile(path); err != nil {
+		t.Fatal(err)
+	} else if string(data) != `old` {
+		t.Errorf(`snapshot %q after failed export, want "old"`, data)
+	}
+	if _, err := os.Stat(path + `.tmp`); !os.IsNotExist(err) {
+		t.Errorf(`temporary file left: %v`, err)
+	}
+
+	if err := write(`new`, false); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != `new` {
+		t.Errorf(`snapshot %q, want "new"`, data)
+	}
+}
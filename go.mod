@@ -0,0 +1,3 @@
+module github.com/atercattus/bicycle-mrhlc
+
+go 1.19
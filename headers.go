@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+)
+
+/*
+Заголовки запроса и ответа.
+
+Ключи и значения копируются во внутренний буфер и хранятся как смещения в нем,
+так что вызывающий может передавать временные срезы. Буферы живут вместе с RequestCtx
+и переиспользуются между запросами, после прогрева аллокаций нет.
+Поиск по ключу без учета регистра.
+*/
+
+const (
+	headersMaxKeptBufSize = 64 * 1024 // буфер больше этого не переиспользуется между соединениями
+)
+
+type (
+	Headers struct {
+		kv  []headerKV
+		buf []byte
+	}
+
+	headerKV struct {
+		keyFrom, keyTo     int32
+		valueFrom, valueTo int32
+	}
+)
+
+func (h *Headers) Reset() {
+	h.kv = h.kv[:0]
+	h.buf = h.buf[:0]
+}
+
+// сброс с освобождением слишком разросшихся буферов
+func (h *Headers) release() {
+	if cap(h.buf) > headersMaxKeptBufSize {
+		h.buf = nil
+		h.kv = nil
+	}
+	h.Reset()
+}
+
+func (h *Headers) Len() int {
+	return len(h.kv)
+}
+
+// значение первого заголовка с таким ключом. nil - заголовка нет
+func (h *Headers) Peek(key []byte) []byte {
+	if idx := h.find(key); idx != -1 {
+		return h.value(idx)
+	}
+	return nil
+}
+
+func (h *Headers) Has(key []byte) bool {
+	return h.find(key) != -1
+}
+
+// добавление еще одного заголовка, даже если такой уже есть
+func (h *Headers) Add(key, value []byte) {
+	kv := headerKV{keyFrom: int32(len(h.buf))}
+	h.buf = append(h.buf, key...)
+	kv.keyTo = int32(len(h.buf))
+
+	kv.valueFrom = kv.keyTo
+	h.buf = append(h.buf, value...)
+	kv.valueTo = int32(len(h.buf))
+
+	h.kv = append(h.kv, kv)
+}
+
+// замена всех заголовков с таким ключом одним
+func (h *Headers) Set(key, value []byte) {
+	h.Del(key)
+	h.Add(key, value)
+}
+
+// удаление всех заголовков с таким ключом. место в буфере не освобождается до Reset
+func (h *Headers) Del(key []byte) {
+	kv := h.kv[:0]
+	for i := range h.kv {
+		if !bytes.EqualFold(h.key(i), key) {
+			kv = append(kv, h.kv[i])
+		}
+	}
+	h.kv = kv
+}
+
+// обход в порядке добавления. cb возвращает false, чтобы прервать обход
+func (h *Headers) VisitAll(cb func(key, value []byte) bool) {
+	for i := range h.kv {
+		if !cb(h.key(i), h.value(i)) {
+			return
+		}
+	}
+}
+
+// дописывает заголовки в формате HTTP "Key: value\r\n"
+func (h *Headers) AppendTo(buf []byte) []byte {
+	for i := range h.kv {
+		buf = append(buf, h.key(i)...)
+		buf = append(buf, ": "...)
+		buf = append(buf, h.value(i)...)
+		buf = append(buf, "\r\n"...)
+	}
+	return buf
+}
+
+func (h *Headers) find(key []byte) int {
+	for i := range h.kv {
+		if bytes.EqualFold(h.key(i), key) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (h *Headers) key(idx int) []byte {
+	kv := &h.kv[idx]
+	return h.buf[kv.keyFrom:kv.keyTo:kv.keyTo]
+}
+
+func (h *Headers) value(idx int) []byte {
+	kv := &h.kv[idx]
+	return h.buf[kv.valueFrom:kv.valueTo:kv.valueTo]
+}
@@ -2,23 +2,35 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"log"
 	"runtime"
 	"strconv"
 	"sync"
 	"sync/atomic"
 	"syscall"
+	"time"
 )
 
 type (
 	Method             int
 	parseRequestStatus int
 	parseRequestState  int
+	ConnCloseReason    int
 )
 
 const (
 	MethodGET = Method(iota)
 	MethodPOST
+	MethodHEAD
+	MethodPUT
+	MethodDELETE
+	MethodPATCH
+	MethodOPTIONS
+	MethodsCount
 )
 
 const (
@@ -30,25 +42,119 @@ const (
 const (
 	parseRequestStateBegin = parseRequestState(iota)
 	parseRequestStateHeaders
-	parseRequestStateBody
+	parseRequestStateBody          // тело по Content-Length
+	parseRequestStateChunkSize     // Transfer-Encoding: chunked. строка с размером очередного куска
+	parseRequestStateChunkData     // данные куска
+	parseRequestStateChunkDataEnd  // \r\n после данных
+	parseRequestStateChunkTrailers // заголовки после последнего куска
 )
 
-type (
-	RequestCtx struct {
-		state         parseRequestState
-		contentLength int
-		keepAlive     bool
+// почему закрыто соединение
+const (
+	ConnCloseEOF        = ConnCloseReason(iota) // клиент закрыл соединение
+	ConnCloseServer                             // сервер закрыл после ответа (POST, без keep-alive)
+	ConnCloseEpollError                         // EPOLLERR/EPOLLHUP
+	ConnCloseReadError
+	ConnCloseWriteError
+	ConnCloseEpollCtlError
+	ConnCloseTimeout    // истек один из таймаутов HTTPServer
+	ConnCloseBadRequest // запрос не разобрать или он слишком большой
+	ConnCloseShutdown   // HTTPServer.Shutdown
+	ConnCloseTLSError   // не удалось рукопожатие или испорчены TLS записи
+	ConnCloseReasonsCount
+)
+
+const (
+	inputBufSize          = 16 * 1024
+	outputBufSize         = 16 * 1024
+	userBufSize           = 16 * 1024
+	maxKeptBufSize        = 256 * 1024 // буферы больше этого не переиспользуются между соединениями
+	defaultMaxRequestSize = 1024 * 1024
+	chunkLineMax          = 4096 // строка с размером куска chunked или трейлер
+)
+
+var (
+	methodNames = [MethodsCount]string{
+		MethodGET:     `GET`,
+		MethodPOST:    `POST`,
+		MethodHEAD:    `HEAD`,
+		MethodPUT:     `PUT`,
+		MethodDELETE:  `DELETE`,
+		MethodPATCH:   `PATCH`,
+		MethodOPTIONS: `OPTIONS`,
+	}
+
+	ConnCloseReasonNames = [ConnCloseReasonsCount]string{
+		ConnCloseEOF:           `eof`,
+		ConnCloseServer:        `server`,
+		ConnCloseEpollError:    `epoll_error`,
+		ConnCloseReadError:     `read_error`,
+		ConnCloseWriteError:    `write_error`,
+		ConnCloseEpollCtlError: `epoll_ctl_error`,
+		ConnCloseTimeout:       `timeout`,
+		ConnCloseBadRequest:    `bad_request`,
+		ConnCloseShutdown:      `shutdown`,
+		ConnCloseTLSError:      `tls_error`,
+	}
 
-		Method Method
-		Path   []byte
-		Body   []byte
+	ErrServerClosed = errors.New(`http: Server closed`)
+)
 
-		ResponseStatus int
-		ResponseBody   []byte
+// стадии остановки сервера
+const (
+	httpShutdownNone  = int32(iota)
+	httpShutdownDrain // новые соединения не принимаются, начатые запросы дообрабатываются
+	httpShutdownForce // закрыть все соединения немедленно
+)
 
-		inputBuf     []byte
-		inputBufOffs int
-		outputBuf    []byte
+type (
+	RequestCtx struct {
+		state          parseRequestState
+		contentLength  int
+		hasLength      bool // был заголовок Content-Length, пусть и 0
+		keepAlive      bool
+		http11         bool
+		chunked        bool
+		chunkLeft      int  // сколько байт текущего куска еще не разобрано
+		bodyStart      int  // смещение тела в inputBuf. куски chunked склеиваются сюда же на месте
+		bodyLen        int  // сколько байт тела уже склеено
+		expectContinue bool // клиент ждет "100 Continue" перед отправкой тела
+		errorStatus    int  // код ответа для parseRequestStatusBadRequest. 0 - 400
+
+		Method         Method
+		Path           []byte
+		Body           []byte
+		RequestHeaders Headers // все заголовки запроса, ключи в нижнем регистре
+		Route          int     // номер маршрута, выставляется обработчиком для метрик и журналов. сервер его не трогает
+
+		ResponseStatus  int
+		ResponseBody    []byte
+		ResponseHeaders Headers // Content-Type по умолчанию application/json. Content-Length, Connection и Server выставляет сервер
+
+		inputBuf       []byte
+		inputLen       int // сколько байт прочитано в inputBuf
+		parsePos       int // сколько из них уже разобрано parseRequest
+		outputBuf      []byte
+		outputPending  []byte // часть ответа, не влезшая в сокет. для TLS - уже зашифрованная
+		interimPending bool   // в outputPending не ответ, а 100 Continue или рукопожатие TLS
+
+		streaming    bool          // заголовки уже ушли, тело идет кусками через Write (см. stream.go)
+		streamBroken bool          // запись в сокет не удалась, остаток ответа выбрасывается
+		streamBytes  int           // сколько байт тела отдано в потоковом режиме
+		encoder      streamEncoder // сжатие потокового ответа, nil - без сжатия. свой у каждого ответа
+		chunkWriter  streamChunkWriter
+		pipe         *streamPipe // тело готовит горутина StreamAsync
+		pipeBuf      []byte      // куда забираются данные из pipe
+		pipeWatch    bool        // pipe ждет EPOLLOUT: в сокете лежит streamPendingLimit и больше
+
+		async bool // обработчик вызвал Async, ответ будет позже (см. async.go)
+
+		fd           int
+		tls          *tlsConn // nil - соединение без TLS
+		loop         *httpLoop
+		connId       uint64 // порядковый номер соединения в HTTPServer
+		requestStart int64  // UnixNano первого байта текущего запроса, 0 - запрос еще не начат
+		timer        connTimer
 
 		UserBuf []byte // может использоваться внутри RequestHandler как угодно, сервер его не трогает
 	}
@@ -56,114 +162,376 @@ type (
 	RequestHandler func(ctx *RequestCtx)
 
 	HTTPServer struct {
-		Handler                RequestHandler
+		Handler        RequestHandler
+		MaxConnections int32 // 0 - без ограничения. сверх лимита новые соединения получают 503 и закрываются
+		MaxRequestSize int   // заголовки и отдельно тело, у chunked без служебных строк. 0 - defaultMaxRequestSize
+		MaxBodySize    int   // тело после распаковки Content-Encoding. 0 - как MaxRequestSize
+		Listeners      int   // число слушающих сокетов и epoll горутин. 0 - по числу CPU, но не больше 4
+		AccessLog      *AccessLog
+		Compression    *CompressOptions // nil - ответы не сжимаются
+		TLSConfig      *tls.Config      // для адресов с tls:
+
+		// 0 - без ограничения
+		ReadHeaderTimeout time.Duration // от подключения или первого байта запроса до конца заголовков
+		BodyTimeout       time.Duration // от конца заголовков до конца тела
+		IdleTimeout       time.Duration // ожидание следующего запроса по keep-alive и медленное чтение ответа
+
 		httpCurrentConnections int32
+		shutdownState          int32
+		connSeq                uint64
+
+		mu        sync.Mutex // защищает listeners, serving и done
+		listeners []*httpListener
+		serving   bool
+		done      chan struct{} // закрывается, когда ListenAndServe все остановил
+	}
+
+	// счетчики соединений одного слушателя (или всего сервера)
+	HTTPConnStats struct {
+		Current  int32 // открыто сейчас
+		Accepted int64 // принято всего
+		Rejected int64 // отброшено из-за MaxConnections
+		Closed   int64 // закрыто всего
+		ClosedBy [ConnCloseReasonsCount]int64
+	}
+
+	// слушающий сокет со своим epoll и своей горутиной
+	httpListener struct {
+		addr     ListenAddr
+		serverFd int // -1 после остановки приема соединений
+		epollFd  int
+		wakeFd   int // eventfd для пробуждения epoll горутины
+		stats    HTTPConnStats
+	}
+
+	// состояние одной epoll горутины
+	httpLoop struct {
+		s *HTTPServer
+		l *httpListener
+
+		activeCtx map[int]*RequestCtx
+		usedCtx   []*RequestCtx
+
+		timers   timerWheel
+		compress httpCompressor
+		async    httpAsyncQueue
+		now      int64 // UnixNano на момент последнего EpollWait
+
+		shutdownState int32 // до какой стадии остановки уже дошла горутина
 	}
 )
 
+// полный сброс под новое соединение
 func (c *RequestCtx) Reset() {
+	c.RequestHeaders.release()
+	c.ResponseHeaders.release()
+	c.resetRequest()
+
+	c.inputLen = 0
+	c.parsePos = 0
+	if (cap(c.inputBuf) == 0) || (cap(c.inputBuf) > maxKeptBufSize) {
+		c.inputBuf = make([]byte, inputBufSize, inputBufSize)
+	} else {
+		c.inputBuf = c.inputBuf[:cap(c.inputBuf)]
+	}
+
+	if (cap(c.outputBuf) == 0) || (cap(c.outputBuf) > maxKeptBufSize) {
+		c.outputBuf = make([]byte, 0, outputBufSize)
+	}
+
+	if (cap(c.UserBuf) == 0) || (cap(c.UserBuf) > maxKeptBufSize) {
+		c.UserBuf = make([]byte, 0, userBufSize)
+	}
+}
+
+// сброс перед очередным запросом в том же соединении. входной буфер не трогается
+func (c *RequestCtx) resetRequest() {
 	c.state = parseRequestStateBegin
 	c.contentLength = 0
+	c.hasLength = false
 	c.keepAlive = false
+	c.http11 = false
+	c.chunked = false
+	c.chunkLeft = 0
+	c.bodyStart = 0
+	c.bodyLen = 0
+	c.expectContinue = false
+	c.errorStatus = 0
+
+	c.requestStart = 0
 
 	c.Method = MethodGET
 	c.Path = nil
 	c.Body = nil
+	c.RequestHeaders.Reset()
+	c.Route = 0
 
 	c.ResponseStatus = 200
 	c.ResponseBody = nil
+	c.ResponseHeaders.Reset()
 
-	c.inputBufOffs = 0
-	if cap(c.inputBuf) == 0 {
-		c.inputBuf = make([]byte, 16*1024, 16*1024)
-	} else {
-		c.inputBuf = c.inputBuf[:]
+	c.outputBuf = c.outputBuf[:0]
+	c.outputPending = nil
+	c.interimPending = false
+
+	c.streaming = false
+	c.streamBroken = false
+	c.streamBytes = 0
+	c.encoder = nil
+	c.pipe = nil
+	c.pipeWatch = false
+	c.async = false
+
+	c.UserBuf = c.UserBuf[:0]
+}
+
+// дописывает данные в тело ответа. удобно для отдачи через io.Writer.
+// после StartStream каждый вызов уходит клиенту отдельным куском
+func (c *RequestCtx) Write(p []byte) (int, error) {
+	if c.encoder != nil {
+		return c.encoder.Write(p)
+	} else if c.streaming {
+		return c.writeChunk(p)
 	}
 
-	if cap(c.outputBuf) == 0 {
-		c.outputBuf = make([]byte, 0, 16*1024)
-	} else {
-		c.outputBuf = c.outputBuf[:0]
+	if c.ResponseBody == nil {
+		c.ResponseBody = c.UserBuf[:0]
 	}
+	c.ResponseBody = append(c.ResponseBody, p...)
+	return len(p), nil
+}
 
-	if cap(c.UserBuf) == 0 {
-		c.UserBuf = make([]byte, 0, 16*1024)
-	} else {
-		c.UserBuf = c.UserBuf[:0]
+// ответ с кодом ошибки вместо всего, что обработчик успел подготовить.
+// если заголовки уже отправлены через StartStream, ответ просто обрывается
+func (c *RequestCtx) Error(status int) {
+	if c.streaming {
+		c.streamBroken = true
+		c.keepAlive = false
 	}
+	c.ResponseStatus = status
+	c.ResponseBody = nil
+	c.ResponseHeaders.Reset()
+}
+
+// закрыть соединение после отправки ответа
+func (c *RequestCtx) SetConnectionClose() {
+	c.keepAlive = false
+}
+
+func (c *RequestCtx) SetContentType(contentType []byte) {
+	c.ResponseHeaders.Set(strContentType, contentType)
 }
 
 func (s *HTTPServer) GetCurrentConnections() int32 {
 	return atomic.LoadInt32(&s.httpCurrentConnections)
 }
 
-func (s *HTTPServer) ListenAndServe(port int) error {
-	cpu := runtime.NumCPU()
-	if cpu > 4 {
-		cpu = 4
+// снимок счетчиков соединений: общий и по каждому слушателю
+func (s *HTTPServer) Stats() (total HTTPConnStats, perListener []HTTPConnStats) {
+	s.mu.Lock()
+	listeners := s.listeners
+	s.mu.Unlock()
+
+	perListener = make([]HTTPConnStats, len(listeners))
+
+	for i, l := range listeners {
+		stats := &perListener[i]
+		stats.Current = atomic.LoadInt32(&l.stats.Current)
+		stats.Accepted = atomic.LoadInt64(&l.stats.Accepted)
+		stats.Rejected = atomic.LoadInt64(&l.stats.Rejected)
+		stats.Closed = atomic.LoadInt64(&l.stats.Closed)
+		for reason := range stats.ClosedBy {
+			stats.ClosedBy[reason] = atomic.LoadInt64(&l.stats.ClosedBy[reason])
+		}
+
+		total.Current += stats.Current
+		total.Accepted += stats.Accepted
+		total.Rejected += stats.Rejected
+		total.Closed += stats.Closed
+		for reason := range stats.ClosedBy {
+			total.ClosedBy[reason] += stats.ClosedBy[reason]
+		}
 	}
-	log.Println(`Use`, cpu, `listeners`)
 
-	serverFds := make([]int, 0, cpu)
-	epollFds := make([]int, 0, cpu)
+	return
+}
 
-	defer func() {
-		for i := range serverFds {
-			serverFd := serverFds[i]
-			epollFd := epollFds[i]
+func (s *HTTPServer) maxRequestSize() int {
+	if s.MaxRequestSize > 0 {
+		return s.MaxRequestSize
+	}
+	return defaultMaxRequestSize
+}
+
+func (s *HTTPServer) maxBodySize() int {
+	if s.MaxBodySize > 0 {
+		return s.MaxBodySize
+	}
+	return s.maxRequestSize()
+}
+
+// возвращает nil после Shutdown
+func (s *HTTPServer) ListenAndServe(addrs []ListenAddr) error {
+	s.mu.Lock()
+	if s.serving || (atomic.LoadInt32(&s.shutdownState) != httpShutdownNone) {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	s.serving = true
+	s.done = make(chan struct{})
+	s.mu.Unlock()
+
+	cpu := s.Listeners
+	if cpu <= 0 {
+		cpu = runtime.NumCPU()
+		if cpu > 4 {
+			cpu = 4
+		}
+	}
+
+	listeners := make([]*httpListener, 0, cpu*len(addrs))
 
-			syscall.Close(epollFd)
-			syscall.Close(serverFd)
+	defer func() {
+		for _, l := range listeners {
+			syscall.Close(l.wakeFd)
+			syscall.Close(l.epollFd)
+			if l.serverFd >= 0 {
+				syscall.Close(l.serverFd)
+			}
+			if l.addr.Network == listenNetworkUnix {
+				syscall.Unlink(l.addr.Path)
+			}
 		}
+
+		s.mu.Lock()
+		s.serving = false
+		close(s.done)
+		s.mu.Unlock()
 	}()
 
-	for i := 1; i <= cpu; i++ {
-		if serverFd, err := socketCreateListener(port); err != nil {
-			return err
-		} else if epollFd, err := socketCreateListenerEpoll(serverFd); err != nil {
-			syscall.Close(serverFd)
-			return err
-		} else {
-			serverFds = append(serverFds, serverFd)
-			epollFds = append(epollFds, epollFd)
+	for _, addr := range addrs {
+		if addr.TLS && (s.TLSConfig == nil) {
+			return errTLSNotConfigured
+		}
+
+		count := cpu
+		if !addr.reusePort() {
+			count = 1
+		}
+		log.Println(`Listen on`, addr, `with`, count, `listeners`)
+
+		for i := 1; i <= count; i++ {
+			if serverFd, err := socketCreateListener(addr); err != nil {
+				return fmt.Errorf(`listen on %s: %s`, addr, err)
+			} else if epollFd, err := socketCreateListenerEpoll(serverFd); err != nil {
+				syscall.Close(serverFd)
+				return err
+			} else if wakeFd, err := socketCreateEventFd(epollFd); err != nil {
+				syscall.Close(epollFd)
+				syscall.Close(serverFd)
+				return err
+			} else {
+				listeners = append(listeners, &httpListener{addr: addr, serverFd: serverFd, epollFd: epollFd, wakeFd: wakeFd})
+			}
 		}
 	}
 
 	var wg sync.WaitGroup
-	wg.Add(len(serverFds))
-	for i := range serverFds {
-		serverFd := serverFds[i]
-		epollFd := epollFds[i]
-		go s.epollLoop(epollFd, serverFd)
+	wg.Add(len(listeners))
+
+	// под mu, чтобы Shutdown либо разбудил уже запущенные горутины, либо успел выставить shutdownState до их запуска
+	s.mu.Lock()
+	s.listeners = listeners
+	for _, l := range listeners {
+		go func(l *httpListener) {
+			defer wg.Done()
+			s.epollLoop(l)
+		}(l)
 	}
+	s.mu.Unlock()
+
 	wg.Wait()
 
 	return nil
 }
 
-func (s *HTTPServer) epollLoop(epollFd, serverFd int) {
+// плавная остановка: прием новых соединений прекращается, простаивающие keep-alive соединения закрываются,
+// а начатые запросы дообрабатываются, после чего закрываются и их соединения.
+// если ctx истек раньше, оставшиеся соединения закрываются принудительно и возвращается ctx.Err()
+func (s *HTTPServer) Shutdown(ctx context.Context) error {
+	done := s.setShutdownState(httpShutdownDrain)
+	if done == nil {
+		return nil
+	}
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	s.setShutdownState(httpShutdownForce)
+	<-done
+
+	return ctx.Err()
+}
+
+// выставляет стадию остановки и будит epoll горутины. nil - сервер не запущен
+func (s *HTTPServer) setShutdownState(state int32) (done chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	atomic.StoreInt32(&s.shutdownState, state)
+
+	if !s.serving {
+		return nil
+	}
+
+	for _, l := range s.listeners {
+		if err := socketEventFdNotify(l.wakeFd); err != nil {
+			log.Println(`eventfd write: `, err)
+		}
+	}
+
+	return s.done
+}
+
+func (s *HTTPServer) epollLoop(l *httpListener) {
 	var (
-		epollEvent  syscall.EpollEvent
 		epollEvents [MaxEpollEvents]syscall.EpollEvent
 
-		activeCtx = make(map[int]*RequestCtx, 10) // 2000 ?
-		usedCtx   []*RequestCtx
+		epollFd  = l.epollFd
+		serverFd = l.serverFd
 
-		ctx *RequestCtx
+		lp = httpLoop{
+			s:         s,
+			l:         l,
+			activeCtx: make(map[int]*RequestCtx, 10), // 2000 ?
+			now:       time.Now().UnixNano(),
+		}
 	)
 
-	closeClientFd := func(fd int) {
-		if ctx, ok := activeCtx[fd]; !ok {
-			return
-		} else {
-			syscall.Close(fd)
-			delete(activeCtx, fd)
-			usedCtx = append(usedCtx, ctx)
-		}
+	lp.timers.Init(lp.now)
+	expire := lp.expire
+	defer lp.asyncClose()
+
+	waitTimeout := -1
+	if (s.ReadHeaderTimeout > 0) || (s.BodyTimeout > 0) || (s.IdleTimeout > 0) {
+		waitTimeout = int(timerWheelTick / time.Millisecond)
 	}
 
 	for {
-		nEvents, err := syscall.EpollWait(epollFd, epollEvents[:], -1)
+		if state := atomic.LoadInt32(&s.shutdownState); state != lp.shutdownState {
+			lp.shutdown(state)
+		}
+		if (lp.shutdownState != httpShutdownNone) && (len(lp.activeCtx) == 0) {
+			// все соединения закрыты
+			break
+		}
+
+		nEvents, err := syscall.EpollWait(epollFd, epollEvents[:], waitTimeout)
+		lp.now = time.Now().UnixNano()
+
 		if err != nil {
 			if errno, ok := err.(syscall.Errno); ok && (errno == syscall.EINTR) {
 				continue
@@ -177,158 +545,493 @@ func (s *HTTPServer) epollLoop(epollFd, serverFd int) {
 			fd := int(epollEvents[ev].Fd)
 			events := epollEvents[ev].Events
 
-			if (events&syscall.EPOLLERR != 0) || (events&syscall.EPOLLHUP != 0) || (events&syscall.EPOLLIN == 0) {
-				closeClientFd(fd)
+			if fd == serverFd {
+				if (events&syscall.EPOLLIN != 0) && (lp.shutdownState == httpShutdownNone) {
+					lp.accept()
+				}
 				continue
-			} else if fd == serverFd {
-				for {
-					connFd, _, err := syscall.Accept(serverFd)
-
-					if err != nil {
-						if errno, ok := err.(syscall.Errno); ok {
-							if errno == syscall.EAGAIN {
-								// обработаны все новые коннекты
-							} else {
-								log.Printf("Accept: errno: %v\n", errno)
-							}
-						} else {
-							log.Printf("Accept: %T %s\n", err, err)
-						}
-						break
-					} else if err := socketSetNonBlocking(connFd); err != nil {
-						log.Println("setSocketNonBlocking: ", err)
-						break
-					}
+			} else if fd == l.wakeFd {
+				// shutdownState проверяется в начале каждой итерации
+				socketEventFdDrain(fd)
+				lp.asyncFinish()
+				continue
+			}
 
-					epollEvent.Events = syscall.EPOLLIN | EPOLLET // | syscall.EPOLLOUT
-					epollEvent.Fd = int32(connFd)
-					if err := syscall.EpollCtl(epollFd, syscall.EPOLL_CTL_ADD, connFd, &epollEvent); err != nil {
-						log.Println("EpollCtl: ", err)
-						break
-					}
+			// обработка основых соединений
+
+			ctx, ok := lp.activeCtx[fd]
+			if !ok {
+				// событие по уже закрытому соединению
+				continue
+			}
+
+			if (events&syscall.EPOLLERR != 0) || (events&syscall.EPOLLHUP != 0) || (events&(syscall.EPOLLIN|syscall.EPOLLOUT) == 0) {
+				lp.closeConn(ctx, ConnCloseEpollError)
+				continue
+			}
+
+			if ctx.pipe != nil {
+				// потоковый ответ из горутины: освободившийся сокет принимает следующую порцию
+				if events&syscall.EPOLLOUT != 0 {
+					lp.streamPump(ctx)
 				}
+				continue
+			}
+
+			if len(ctx.outputPending) > 0 {
+				// ждем, пока сокет освободится под остаток прошлого ответа
+				if events&syscall.EPOLLOUT == 0 {
+					continue
+				} else if !lp.flush(ctx) {
+					continue
+				} else if len(ctx.outputPending) > 0 {
+					continue
+				} else if err := socketEpollWatchWrite(epollFd, fd, false); err != nil {
+					log.Println("EpollCtl: ", err)
+					lp.closeConn(ctx, ConnCloseEpollCtlError)
+					continue
+				} else if ctx.interimPending {
+					// продолжаем читать запрос
+					ctx.interimPending = false
+					lp.setReadTimer(ctx)
+				} else if !lp.responseDone(ctx) {
+					continue
+				}
+				// дальше дочитываем то, что могло прийти, пока ждали записи
+			}
 
+			if ctx.async {
+				// соединение дочитается после asyncFinish
 				continue
 			}
+			lp.serve(ctx)
+		}
 
-			// обработка основых соединений
+		lp.timers.Expire(lp.now, expire)
+	}
+}
+
+func (lp *httpLoop) accept() {
+	var epollEvent syscall.EpollEvent
 
-			var ok bool
-			if ctx, ok = activeCtx[fd]; !ok {
-				if l := len(usedCtx); l > 0 {
-					ctx = usedCtx[l-1]
-					usedCtx = usedCtx[:l-1]
+	s, l := lp.s, lp.l
+
+	for {
+		connFd, _, err := syscall.Accept(l.serverFd)
+
+		if err != nil {
+			if errno, ok := err.(syscall.Errno); ok {
+				if errno == syscall.EAGAIN {
+					// обработаны все новые коннекты
 				} else {
-					ctx = &RequestCtx{}
+					log.Printf("Accept: errno: %v\n", errno)
 				}
-				ctx.Reset()
-				activeCtx[fd] = ctx
-			}
-
-			for {
-				nbytes, err := syscall.Read(fd, ctx.inputBuf[ctx.inputBufOffs:])
-
-				if err != nil {
-					allOk := false
-					if errno, ok := err.(syscall.Errno); ok {
-						if errno == syscall.EAGAIN {
-							// обработаны все новые данные
-							allOk = true
-						} else if errno == syscall.EBADF {
-							// видимо, соединение уже закрылось и так чуть раньше по другому условию
-						} else {
-							log.Printf("Read: unknown errno: %v\n", errno)
-						}
-					} else {
-						log.Printf("Read: unknown error type %T: %s\n", err, err)
-					}
+			} else {
+				log.Printf("Accept: %T %s\n", err, err)
+			}
+			break
+		}
 
-					if !allOk {
-						closeClientFd(fd)
-					}
+		atomic.AddInt64(&l.stats.Accepted, 1)
+
+		if (s.MaxConnections > 0) && (atomic.LoadInt32(&s.httpCurrentConnections) >= s.MaxConnections) {
+			// сбрасываем нагрузку: коротко отвечаем и сразу закрываем. по TLS коротко не ответить
+			if !l.addr.TLS {
+				syscall.Write(connFd, responseTooManyConnections)
+			}
+			syscall.Close(connFd)
+			atomic.AddInt64(&l.stats.Rejected, 1)
+			continue
+		} else if err := socketSetNonBlocking(connFd); err != nil {
+			log.Println("setSocketNonBlocking: ", err)
+			syscall.Close(connFd)
+			atomic.AddInt64(&l.stats.Rejected, 1)
+			break
+		}
+
+		epollEvent.Events = syscall.EPOLLIN | EPOLLET // | syscall.EPOLLOUT
+		epollEvent.Fd = int32(connFd)
+		if err := syscall.EpollCtl(l.epollFd, syscall.EPOLL_CTL_ADD, connFd, &epollEvent); err != nil {
+			log.Println("EpollCtl: ", err)
+			syscall.Close(connFd)
+			atomic.AddInt64(&l.stats.Rejected, 1)
+			break
+		}
+
+		var ctx *RequestCtx
+		if n := len(lp.usedCtx); n > 0 {
+			ctx = lp.usedCtx[n-1]
+			lp.usedCtx = lp.usedCtx[:n-1]
+		} else {
+			ctx = &RequestCtx{}
+		}
+		ctx.Reset()
+		ctx.fd = connFd
+		ctx.loop = lp
+		if l.addr.TLS {
+			ctx.tls = newTLSConn(s.TLSConfig)
+		}
+		ctx.connId = atomic.AddUint64(&s.connSeq, 1)
+		lp.activeCtx[connFd] = ctx
+
+		atomic.AddInt32(&s.httpCurrentConnections, 1)
+		atomic.AddInt32(&l.stats.Current, 1)
+
+		// первый запрос должен прийти так же быстро, как и заголовки
+		lp.setTimer(ctx, connTimeoutHeader)
+	}
+}
+
+func (lp *httpLoop) shutdown(state int32) {
+	if lp.shutdownState == httpShutdownNone {
+		// закрытие слушающего сокета заодно убирает его из epoll
+		syscall.Close(lp.l.serverFd)
+		lp.l.serverFd = -1
+	}
+	lp.shutdownState = state
+
+	for _, ctx := range lp.activeCtx {
+		// соединение между запросами, ответ на предыдущий уже ушел целиком
+		idle := (ctx.inputLen == 0) && (len(ctx.outputPending) == 0)
+
+		if (state == httpShutdownForce) || idle {
+			lp.closeConn(ctx, ConnCloseShutdown)
+		}
+	}
+}
+
+func (lp *httpLoop) closeConn(ctx *RequestCtx, reason ConnCloseReason) {
+	fd := ctx.fd
+	if lp.activeCtx[fd] != ctx {
+		return
+	}
+
+	if ctx.tls != nil {
+		if alert := ctx.tls.close(ctx.outputPending); len(alert) > 0 {
+			// close_notify, если сокет примет его сразу
+			syscall.Write(fd, alert)
+		}
+		ctx.tls = nil
+	}
+
+	if ctx.pipe != nil {
+		// горутина StreamAsync не должна вечно ждать места в pipe
+		ctx.pipe.abort()
+		ctx.pipe = nil
+	}
+
+	syscall.Close(fd)
+	delete(lp.activeCtx, fd)
+	lp.timers.Remove(ctx)
+	lp.usedCtx = append(lp.usedCtx, ctx)
+
+	atomic.AddInt32(&lp.s.httpCurrentConnections, -1)
+	atomic.AddInt32(&lp.l.stats.Current, -1)
+	atomic.AddInt64(&lp.l.stats.Closed, 1)
+	atomic.AddInt64(&lp.l.stats.ClosedBy[reason], 1)
+}
+
+// чтение и обработка запросов, пока в сокете есть данные
+func (lp *httpLoop) serve(ctx *RequestCtx) {
+	s := lp.s
+
+	// в буфере может лежать следующий запрос, пришедший вместе с предыдущим
+	hasInput := ctx.parsePos < ctx.inputLen
 
-					break
+	for {
+		if !hasInput && !lp.read(ctx) {
+			return
+		}
+		hasInput = false
+
+		if ctx.requestStart == 0 {
+			ctx.requestStart = lp.now
+		}
+
+		status := s.parseRequest(ctx)
+		if (status == parseRequestStatusNeedMore) && (ctx.inputLen == len(ctx.inputBuf)) {
+			ctx.compactChunks()
+			if (ctx.inputLen == len(ctx.inputBuf)) && !ctx.growInput(ctx.inputLimit(s.maxRequestSize())) {
+				if ctx.state < parseRequestStateBody {
+					// заголовки больше MaxRequestSize
+					lp.closeConn(ctx, ConnCloseBadRequest)
+					return
 				}
+				ctx.errorStatus = 413
+				status = parseRequestStatusBadRequest
+			}
+		}
 
-				if nbytes > 0 {
-					status, bufNew := s.parseRequest(ctx.inputBuf[ctx.inputBufOffs:ctx.inputBufOffs+nbytes], ctx)
-
-					switch status {
-					case parseRequestStatusOk:
-						if s.Handler != nil {
-							s.Handler(ctx)
-						}
-					case parseRequestStatusNeedMore:
-						ctx.inputBufOffs += nbytes
-						continue
-					case parseRequestStatusBadRequest:
-						ctx.ResponseStatus = 400
-					}
+		switch status {
+		case parseRequestStatusNeedMore:
+			if ctx.state >= parseRequestStateBody {
+				if ctx.expectContinue {
+					// клиент не шлет тело, пока не получит разрешение
+					ctx.expectContinue = false
 
-					buf := s.buildResponse(ctx)
-					if n, err := syscall.Write(fd, buf); err != nil {
-						log.Println(`Write`, err)
-					} else if n != len(buf) {
-						log.Println(`Write`, n, `!=`, len(buf))
+					interim := responseContinue
+					if ctx.tls != nil {
+						interim = ctx.tls.seal(nil, interim)
 					}
-
-					if ctx.Method == MethodPOST {
-						// яндекс.Танк не умеет в нормальные POST запросы, присылая два лишних байта "\r\n"
-						closeClientFd(fd)
-						// ToDo: вычитывать их и работать дальше? ;)
-						break
-					} else {
-						ctx.Reset()
-
-						if len(bufNew) > 0 {
-							log.Println(`buffer tail`, len(bufNew), string(bufNew))
-							copy(ctx.inputBuf, bufNew)
-							ctx.inputBufOffs = len(bufNew)
-						} else {
-							ctx.inputBufOffs = 0
-						}
+					if !lp.writeInterim(ctx, interim) || (len(ctx.outputPending) > 0) {
+						// остаток уйдет по EPOLLOUT
+						return
 					}
+				}
+				lp.setTimer(ctx, connTimeoutBody)
+			} else {
+				lp.setTimer(ctx, connTimeoutHeader)
+			}
+			continue
+
+		case parseRequestStatusOk:
+			lp.timers.Remove(ctx)
+			if status := lp.decompressRequest(ctx); status != 0 {
+				// тело прочитано целиком, так что соединение можно не закрывать
+				ctx.ResponseStatus = status
+			} else if s.Handler != nil {
+				s.Handler(ctx)
+			}
 
+		case parseRequestStatusBadRequest:
+			// где начинается следующий запрос, уже не понять
+			ctx.ResponseStatus = 400
+			if ctx.errorStatus != 0 {
+				ctx.ResponseStatus = ctx.errorStatus
+			}
+			ctx.keepAlive = false
+		}
+
+		if ctx.async {
+			// ответ отправит asyncFinish
+			return
+		}
+		if !lp.respond(ctx) {
+			return
+		}
+
+		hasInput = ctx.parsePos < ctx.inputLen
+	}
+}
+
+// одно чтение запроса. false - данных пока нет или соединение закрыто
+func (lp *httpLoop) read(ctx *RequestCtx) bool {
+	if ctx.tls != nil {
+		return lp.readTLS(ctx)
+	}
+
+	nbytes, ok := lp.readSocket(ctx, ctx.inputBuf[ctx.inputLen:])
+	ctx.inputLen += nbytes
+	return ok
+}
+
+// одно чтение из сокета в buf. false - данных пока нет или соединение закрыто
+func (lp *httpLoop) readSocket(ctx *RequestCtx, buf []byte) (int, bool) {
+	for {
+		nbytes, err := syscall.Read(ctx.fd, buf)
+
+		if err != nil {
+			if errno, ok := err.(syscall.Errno); ok {
+				if errno == syscall.EAGAIN {
+					// обработаны все новые данные
+					return 0, false
+				} else if errno == syscall.EINTR {
+					continue
+				} else if errno == syscall.EBADF {
+					// видимо, соединение уже закрылось и так чуть раньше по другому условию
 				} else {
-					// соединение закрылось
-					closeClientFd(fd)
+					log.Printf("Read: unknown errno: %v\n", errno)
 				}
+			} else {
+				log.Printf("Read: unknown error type %T: %s\n", err, err)
 			}
+
+			lp.closeConn(ctx, ConnCloseReadError)
+			return 0, false
+		} else if nbytes == 0 {
+			// соединение закрылось
+			lp.closeConn(ctx, ConnCloseEOF)
+			return 0, false
 		}
+
+		return nbytes, true
 	}
 }
 
-func (s *HTTPServer) buildResponse(ctx *RequestCtx) []byte {
-	var line []byte
-	switch ctx.ResponseStatus {
-	case 200:
-		line = line200
-	case 400:
-		line = line400
-	case 404:
-		line = line404
-	default:
-		line = line500
+// служебная запись посреди чтения запроса (100 Continue, рукопожатие TLS). false - соединение закрыто.
+// если сокет принял не все, остаток уходит по EPOLLOUT, после чего чтение запроса продолжается
+func (lp *httpLoop) writeInterim(ctx *RequestCtx, p []byte) bool {
+	ctx.outputPending = p
+	if !lp.flush(ctx) {
+		return false
+	} else if len(ctx.outputPending) == 0 {
+		return true
 	}
 
-	tmpBuf := ctx.outputBuf
+	ctx.interimPending = true
+	if err := socketEpollWatchWrite(lp.l.epollFd, ctx.fd, true); err != nil {
+		log.Println("EpollCtl: ", err)
+		lp.closeConn(ctx, ConnCloseEpollCtlError)
+		return false
+	}
+	lp.setTimer(ctx, connTimeoutWrite)
 
-	// формирование ответа
-	tmpBuf = append(tmpBuf[:0], line...)
+	return true
+}
 
-	tmpBuf = append(tmpBuf, "Content-Type: application/json\r\nServer: yocto_http\r\n"...)
+// сколько байт inputBuf может занять запрос. MaxRequestSize ограничивает отдельно заголовки и тело,
+// причем у chunked тела считаются только данные, а не служебные строки
+func (c *RequestCtx) inputLimit(max int) int {
+	switch {
+	case c.state == parseRequestStateBody:
+		return c.parsePos + max
+	case c.state > parseRequestStateBody:
+		return c.bodyStart + max + chunkLineMax
+	}
+	return max
+}
 
-	tmpBuf = append(tmpBuf, "Content-Length: "...)
-	tmpBuf = strconv.AppendUint(tmpBuf, uint64(len(ctx.ResponseBody)), 10)
-	tmpBuf = append(tmpBuf, "\r\n"...)
+// выкидывает из буфера уже разобранные строки с размерами кусков, чтобы они не занимали место под тело
+func (c *RequestCtx) compactChunks() {
+	if c.state <= parseRequestStateBody {
+		return
+	}
+	end := c.bodyStart + c.bodyLen
+	if end < c.parsePos {
+		c.inputLen = end + copy(c.inputBuf[end:], c.inputBuf[c.parsePos:c.inputLen])
+		c.parsePos = end
+	}
+}
 
-	if ctx.keepAlive {
-		tmpBuf = append(tmpBuf, "Connection: keep-alive\r\n"...)
+// увеличение входного буфера под длинный запрос. false - упираемся в limit
+func (c *RequestCtx) growInput(limit int) bool {
+	size := 2 * len(c.inputBuf)
+	if c.state == parseRequestStateBody {
+		// длина тела уже известна, можно выделить сразу сколько нужно
+		if need := c.parsePos + c.contentLength; need > size {
+			size = need
+		}
+	}
+	if size > limit {
+		size = limit
+	}
+	if size <= len(c.inputBuf) {
+		return false
 	}
 
-	tmpBuf = append(tmpBuf, "\r\n"...)
+	// Path и прочие уже разобранные срезы продолжают ссылаться на старый буфер, это нормально
+	buf := make([]byte, size, size)
+	copy(buf, c.inputBuf[:c.inputLen])
+	c.inputBuf = buf
+
+	return true
+}
+
+// отправка ответа на разобранный запрос. false - ответ не ушел целиком или соединение закрыто
+func (lp *httpLoop) respond(ctx *RequestCtx) bool {
+	if lp.shutdownState != httpShutdownNone {
+		// это последний ответ в соединении
+		ctx.keepAlive = false
+	}
+
+	if ctx.streaming {
+		ctx.outputPending = ctx.finishStream()
+		if ctx.streamBroken {
+			lp.closeConn(ctx, ConnCloseWriteError)
+			return false
+		}
+	} else {
+		lp.compressResponse(ctx)
+		ctx.outputPending = lp.s.buildResponse(ctx)
+		if ctx.tls != nil {
+			ctx.outputPending = ctx.tls.seal(nil, ctx.outputPending)
+		}
+	}
+
+	if lp.s.AccessLog != nil {
+		lp.s.AccessLog.Log(ctx)
+	}
+
+	if !lp.flush(ctx) {
+		return false
+	} else if len(ctx.outputPending) > 0 {
+		// ответ не влез в сокет целиком. допишем по EPOLLOUT
+		if err := socketEpollWatchWrite(lp.l.epollFd, ctx.fd, true); err != nil {
+			log.Println("EpollCtl: ", err)
+			lp.closeConn(ctx, ConnCloseEpollCtlError)
+			return false
+		}
+		lp.setTimer(ctx, connTimeoutWrite)
+		return false
+	}
+
+	return lp.responseDone(ctx)
+}
+
+// пишет в сокет ctx.outputPending, сколько получится без блокировки. false - соединение закрыто
+func (lp *httpLoop) flush(ctx *RequestCtx) bool {
+	written := false
+
+	for len(ctx.outputPending) > 0 {
+		n, err := syscall.Write(ctx.fd, ctx.outputPending)
+		if err != nil {
+			if errno, ok := err.(syscall.Errno); ok && (errno == syscall.EAGAIN) {
+				break
+			} else if ok && (errno == syscall.EINTR) {
+				continue
+			}
+			log.Println(`Write`, err)
+			lp.closeConn(ctx, ConnCloseWriteError)
+			return false
+		}
+		ctx.outputPending = ctx.outputPending[n:]
+		written = true
+	}
+
+	if len(ctx.outputPending) == 0 {
+		ctx.outputPending = nil
+	} else if written {
+		// клиент читает, пусть и медленно
+		lp.setTimer(ctx, connTimeoutWrite)
+	}
+
+	return true
+}
+
+// подготовка соединения к следующему запросу после полной отправки ответа. false - соединение закрыто
+func (lp *httpLoop) responseDone(ctx *RequestCtx) bool {
+	if ctx.Method == MethodPOST {
+		// яндекс.Танк не умеет в нормальные POST запросы, присылая два лишних байта "\r\n"
+		// ToDo: вычитывать их и работать дальше? ;)
+		lp.closeConn(ctx, ConnCloseServer)
+		return false
+	} else if !ctx.keepAlive {
+		lp.closeConn(ctx, ConnCloseServer)
+		return false
+	}
+
+	// начало следующего запроса (если уже пришло) переносим в начало буфера
+	ctx.inputLen = copy(ctx.inputBuf, ctx.inputBuf[ctx.parsePos:ctx.inputLen])
+	ctx.parsePos = 0
+	ctx.resetRequest()
 
-	if ctx.ResponseBody != nil {
+	if ctx.inputLen > 0 {
+		ctx.requestStart = lp.now
+		lp.setTimer(ctx, connTimeoutHeader)
+	} else {
+		lp.setTimer(ctx, connTimeoutIdle)
+	}
+
+	return true
+}
+
+// HEAD получает те же заголовки, что и GET, включая Content-Length, но без тела.
+// у 1xx, 204 и 304 нет ни тела, ни Content-Length
+func (s *HTTPServer) buildResponse(ctx *RequestCtx) []byte {
+	// формирование ответа
+	tmpBuf := appendResponseHeaders(ctx.outputBuf[:0], ctx, false)
+
+	if !statusBodiless(ctx.ResponseStatus) && (ctx.Method != MethodHEAD) {
 		tmpBuf = append(tmpBuf, ctx.ResponseBody...)
 	}
 
@@ -337,71 +1040,119 @@ func (s *HTTPServer) buildResponse(ctx *RequestCtx) []byte {
 	return tmpBuf
 }
 
-func (s *HTTPServer) parseRequest(buf []byte, ctx *RequestCtx) (parseRequestStatus, []byte) {
+// статусная строка и заголовки вместе с пустой строкой после них.
+// stream - длина тела заранее неизвестна: chunked для HTTP/1.1, иначе тело до закрытия соединения
+func appendResponseHeaders(tmpBuf []byte, ctx *RequestCtx, stream bool) []byte {
+	bodiless := statusBodiless(ctx.ResponseStatus)
+
+	tmpBuf = append(tmpBuf, statusLine(ctx.ResponseStatus)...)
+
+	if !bodiless && !ctx.ResponseHeaders.Has(strContentType) {
+		tmpBuf = append(tmpBuf, "Content-Type: application/json\r\n"...)
+	}
+	tmpBuf = append(tmpBuf, "Server: yocto_http\r\n"...)
+
+	switch {
+	case bodiless:
+		// ни тела, ни длины
+	case !stream:
+		tmpBuf = append(tmpBuf, "Content-Length: "...)
+		tmpBuf = strconv.AppendUint(tmpBuf, uint64(len(ctx.ResponseBody)), 10)
+		tmpBuf = append(tmpBuf, "\r\n"...)
+	case ctx.http11:
+		tmpBuf = append(tmpBuf, "Transfer-Encoding: chunked\r\n"...)
+	}
+
+	if ctx.keepAlive {
+		tmpBuf = append(tmpBuf, "Connection: keep-alive\r\n"...)
+	} else {
+		tmpBuf = append(tmpBuf, "Connection: close\r\n"...)
+	}
+
+	tmpBuf = ctx.ResponseHeaders.AppendTo(tmpBuf)
+
+	tmpBuf = append(tmpBuf, "\r\n"...)
+
+	return tmpBuf
+}
+
+// разбор очередной порции ctx.inputBuf[ctx.parsePos:ctx.inputLen]. разобранные строки сдвигают parsePos,
+// незаконченная строка остается до следующего вызова
+func (s *HTTPServer) parseRequest(ctx *RequestCtx) parseRequestStatus {
 	var idx int
 
 	for {
+		buf := ctx.inputBuf[ctx.parsePos:ctx.inputLen]
+
 		switch ctx.state {
 		case parseRequestStateBegin:
-			if idx = bytes.IndexByte(buf, '\n'); idx == -1 {
-				return parseRequestStatusNeedMore, buf
+			line, ok := ctx.nextLine(buf)
+			if !ok {
+				return parseRequestStatusNeedMore
+			} else if len(line) == 0 {
+				// пустые строки перед запросом допускаются (RFC 7230 3.5)
+				continue
 			}
 
 			ctx.state = parseRequestStateHeaders
 
 			// GET /path/to/file HTTP/1.1
-			line := buf[:idx-1] // \r\n
-			buf = buf[idx+1:]
 			if idx = bytes.IndexByte(line, ' '); idx == -1 {
-				return parseRequestStatusBadRequest, buf
+				return parseRequestStatusBadRequest
 			}
 
 			// GET
-			if method := line[0:idx]; bytes.Equal(method, strGET) {
-				ctx.Method = MethodGET
-			} else if bytes.Equal(method, strPOST) {
-				ctx.Method = MethodPOST
+			if method, ok := parseMethod(line[0:idx]); !ok {
+				return parseRequestStatusBadRequest
 			} else {
-				return parseRequestStatusBadRequest, buf
+				ctx.Method = method
 			}
 			line = line[idx+1:]
 
 			// /path/to/file
-			if idx = bytes.IndexByte(line, ' '); idx == -1 {
-				return parseRequestStatusBadRequest, buf
+			if idx = bytes.IndexByte(line, ' '); idx <= 0 {
+				return parseRequestStatusBadRequest
 			}
 			ctx.Path = line[:idx]
 
 			// HTTP/1.1 поддерживает keep-alive по умолчанию
 			if bytes.HasSuffix(line, str11) {
+				ctx.http11 = true
 				ctx.keepAlive = true
 			}
 
 		case parseRequestStateHeaders:
-			if idx = bytes.IndexByte(buf, '\n'); idx == -1 {
-				return parseRequestStatusNeedMore, buf
+			line, ok := ctx.nextLine(buf)
+			if !ok {
+				return parseRequestStatusNeedMore
 			}
 
-			line := buf[:idx-1] // \r\n
-			buf = buf[idx+1:]
 			if len(line) == 0 {
-				if ctx.contentLength == 0 {
+				if ctx.chunked {
+					if ctx.hasLength {
+						// RFC 9112 6.1: так подделывают границы запросов, отказываем при любом Content-Length
+						return parseRequestStatusBadRequest
+					}
+					ctx.bodyStart = ctx.parsePos
+					ctx.state = parseRequestStateChunkSize
+				} else if ctx.contentLength == 0 {
 					// все, распарсили запрос
-					return parseRequestStatusOk, buf
+					return parseRequestStatusOk
+				} else if ctx.contentLength > s.maxRequestSize() {
+					ctx.errorStatus = 413
+					return parseRequestStatusBadRequest
 				} else {
 					ctx.state = parseRequestStateBody
 				}
-			} else if idx = bytes.IndexByte(line, ':'); idx == -1 {
-				return parseRequestStatusBadRequest, buf
+			} else if key, value, ok := ctx.parseHeader(line); !ok {
+				return parseRequestStatusBadRequest
 			} else {
-				key, value := line[:idx], bytesTrimLeftInplace(line[idx+1:])
-				bytesToLowerInplace(key)
-
 				if bytes.Equal(key, strContentLength) {
-					if i64, ok := byteSliceToInt64(value); !ok {
-						return parseRequestStatusBadRequest, buf
+					if i64, ok := byteSliceToInt64(value); !ok || (i64 < 0) {
+						return parseRequestStatusBadRequest
 					} else {
 						ctx.contentLength = int(i64)
+						ctx.hasLength = true
 					}
 				} else if bytes.Equal(key, strConnection) {
 					bytesToLowerInplace(value)
@@ -410,26 +1161,184 @@ func (s *HTTPServer) parseRequest(buf []byte, ctx *RequestCtx) (parseRequestStat
 					} else if bytes.Equal(value, strClose) {
 						ctx.keepAlive = false
 					}
+				} else if bytes.Equal(key, strTransferEncoding) {
+					bytesToLowerInplace(value)
+					if !bytes.Equal(value, strChunked) {
+						// другие кодировки (gzip, compress) и цепочки вроде "gzip, chunked" не поддерживаются
+						ctx.errorStatus = 501
+						return parseRequestStatusBadRequest
+					}
+					ctx.chunked = true
+				} else if bytes.Equal(key, strExpect) {
+					bytesToLowerInplace(value)
+					if !bytes.Equal(value, str100Continue) {
+						ctx.errorStatus = 417
+						return parseRequestStatusBadRequest
+					}
+					// HTTP/1.0 клиенты 100 Continue не понимают (RFC 7231 5.1.1)
+					ctx.expectContinue = ctx.http11
 				}
 			}
 
 		case parseRequestStateBody:
 			l := ctx.contentLength
 			if len(buf) < l {
-				return parseRequestStatusNeedMore, buf
+				return parseRequestStatusNeedMore
 			}
 
 			ctx.Body = buf[:l]
-			buf = buf[l:]
+			ctx.parsePos += l
+
+			return parseRequestStatusOk
+
+		case parseRequestStateChunkSize:
+			line, ok := ctx.nextLine(buf)
+			if !ok {
+				return parseRequestStatusNeedMore
+			}
+
+			size, ok := parseChunkSize(line)
+			if !ok {
+				return parseRequestStatusBadRequest
+			} else if ctx.bodyLen+size > s.maxRequestSize() {
+				ctx.errorStatus = 413
+				return parseRequestStatusBadRequest
+			} else if size == 0 {
+				ctx.state = parseRequestStateChunkTrailers
+			} else {
+				ctx.chunkLeft = size
+				ctx.state = parseRequestStateChunkData
+			}
+
+		case parseRequestStateChunkData:
+			if len(buf) == 0 {
+				return parseRequestStatusNeedMore
+			}
+
+			l := ctx.chunkLeft
+			if len(buf) < l {
+				l = len(buf)
+			}
+
+			// данные сдвигаются влево поверх строк с размерами, так что тело получается непрерывным
+			copy(ctx.inputBuf[ctx.bodyStart+ctx.bodyLen:], buf[:l])
+			ctx.bodyLen += l
+			ctx.parsePos += l
 
-			return parseRequestStatusOk, buf
+			if ctx.chunkLeft -= l; ctx.chunkLeft == 0 {
+				ctx.state = parseRequestStateChunkDataEnd
+			}
+
+		case parseRequestStateChunkDataEnd:
+			line, ok := ctx.nextLine(buf)
+			if !ok {
+				return parseRequestStatusNeedMore
+			} else if len(line) != 0 {
+				return parseRequestStatusBadRequest
+			}
+			ctx.state = parseRequestStateChunkSize
+
+		case parseRequestStateChunkTrailers:
+			line, ok := ctx.nextLine(buf)
+			if !ok {
+				return parseRequestStatusNeedMore
+			}
+
+			if len(line) == 0 {
+				ctx.Body = ctx.inputBuf[ctx.bodyStart : ctx.bodyStart+ctx.bodyLen]
+				return parseRequestStatusOk
+			} else if _, _, ok := splitHeader(line); !ok {
+				// трейлеры только проверяются и отбрасываются: иначе после тела можно было бы
+				// подсунуть Content-Encoding, Authorization или If-Match, которые читаются позже
+				return parseRequestStatusBadRequest
+			}
 
 		default:
 			log.Println(`Bug in code: unexpected parse state`)
-			return parseRequestStatusBadRequest, buf
+			return parseRequestStatusBadRequest
+		}
+	}
+}
+
+func parseMethod(name []byte) (Method, bool) {
+	// GET и POST самые частые, их проверяем первыми
+	if bytes.Equal(name, strGET) {
+		return MethodGET, true
+	} else if bytes.Equal(name, strPOST) {
+		return MethodPOST, true
+	}
+
+	for method := MethodHEAD; method < MethodsCount; method++ {
+		if string(name) == methodNames[method] {
+			return method, true
+		}
+	}
+
+	return MethodGET, false
+}
+
+// очередная строка без \r\n. ok == false - строка еще не пришла целиком
+// "Key: value" -> RequestHeaders. ключ приводится к нижнему регистру
+func (c *RequestCtx) parseHeader(line []byte) (key, value []byte, ok bool) {
+	if key, value, ok = splitHeader(line); ok {
+		c.RequestHeaders.Add(key, value)
+	}
+	return key, value, ok
+}
+
+// "Key: value" -> key в нижнем регистре, value без ведущих пробелов
+func splitHeader(line []byte) (key, value []byte, ok bool) {
+	idx := bytes.IndexByte(line, ':')
+	if idx <= 0 {
+		return nil, nil, false
+	}
+
+	key, value = line[:idx], bytesTrimLeftInplace(line[idx+1:])
+	bytesToLowerInplace(key)
+
+	return key, value, true
+}
+
+// "1a2b;ext=val" -> 0x1a2b
+func parseChunkSize(line []byte) (int, bool) {
+	if idx := bytes.IndexByte(line, ';'); idx != -1 {
+		line = line[:idx]
+	}
+	line = bytes.TrimRight(line, " \t")
+
+	if (len(line) == 0) || (len(line) > 8) {
+		return 0, false
+	}
+
+	size := 0
+	for _, c := range line {
+		switch {
+		case (c >= '0') && (c <= '9'):
+			size = size<<4 | int(c-'0')
+		case (c >= 'a') && (c <= 'f'):
+			size = size<<4 | int(c-'a'+10)
+		case (c >= 'A') && (c <= 'F'):
+			size = size<<4 | int(c-'A'+10)
+		default:
+			return 0, false
 		}
 	}
 
-	log.Println(`Bug in code: after of HTTPServer.parseRequest loop`)
-	return parseRequestStatusBadRequest, buf
+	return size, true
+}
+
+func (c *RequestCtx) nextLine(buf []byte) (line []byte, ok bool) {
+	idx := bytes.IndexByte(buf, '\n')
+	if idx == -1 {
+		return nil, false
+	}
+
+	c.parsePos += idx + 1
+
+	line = buf[:idx]
+	if l := len(line); (l > 0) && (line[l-1] == '\r') {
+		line = line[:l-1]
+	}
+
+	return line, true
 }
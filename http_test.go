@@ -0,0 +1,506 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// разбор запроса, пришедшего кусками parts. возвращает итоговый статус разбора
+func parseTestRequest(s *HTTPServer, parts ...string) (*RequestCtx, parseRequestStatus) {
+	ctx := &RequestCtx{}
+	ctx.Reset()
+
+	status := parseRequestStatusNeedMore
+	for _, part := range parts {
+		for ctx.inputLen+len(part) > len(ctx.inputBuf) {
+			ctx.growInput(1 << 30)
+		}
+		ctx.inputLen += copy(ctx.inputBuf[ctx.inputLen:], part)
+
+		if status = s.parseRequest(ctx); status != parseRequestStatusNeedMore {
+			break
+		}
+	}
+
+	return ctx, status
+}
+
+// по байту, чтобы проверить возобновление разбора в каждом состоянии
+func splitBytes(s string) []string {
+	parts := make([]string, len(s))
+	for i := range s {
+		parts[i] = s[i : i+1]
+	}
+	return parts
+}
+
+func TestParseRequest(t *testing.T) {
+	const post = "POST /users/1 HTTP/1.1\r\n"
+
+	tests := []struct {
+		name        string
+		request     string
+		status      parseRequestStatus
+		errorStatus int
+		body        string
+		keepAlive   bool
+		expect      bool
+	}{
+		{name: `get`, request: "GET /users/1 HTTP/1.1\r\nHost: x\r\n\r\n", status: parseRequestStatusOk, keepAlive: true},
+		{name: `get 1.0`, request: "GET /users/1 HTTP/1.0\r\n\r\n", status: parseRequestStatusOk},
+		{name: `leading crlf`, request: "\r\n\r\nGET / HTTP/1.1\r\n\r\n", status: parseRequestStatusOk, keepAlive: true},
+		{name: `content-length`, request: post + "Content-Length: 5\r\n\r\nhello", status: parseRequestStatusOk, body: `hello`, keepAlive: true},
+		{name: `bad content-length`, request: post + "Content-Length: -1\r\n\r\n", status: parseRequestStatusBadRequest},
+		{name: `too long`, request: post + "Content-Length: 2000000\r\n\r\n", status: parseRequestStatusBadRequest, errorStatus: 413},
+
+		{name: `chunked`, request: post + "Transfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n6\r\n world\r\n0\r\n\r\n", status: parseRequestStatusOk, body: `hello world`, keepAlive: true},
+		{name: `chunk size hex`, request: post + "Transfer-Encoding: Chunked\r\n\r\na\r\n0123456789\r\nB\r\nabcdefghijk\r\n0\r\n\r\n", status: parseRequestStatusOk, body: `0123456789abcdefghijk`, keepAlive: true},
+		{name: `chunk extensions`, request: post + "Transfer-Encoding: chunked\r\n\r\n5;name=val\r\nhello\r\n0 ;last\r\n\r\n", status: parseRequestStatusOk, body: `hello`, keepAlive: true},
+		{name: `bad chunk size`, request: post + "Transfer-Encoding: chunked\r\n\r\nzz\r\n", status: parseRequestStatusBadRequest},
+		{name: `empty chunk size`, request: post + "Transfer-Encoding: chunked\r\n\r\n;ext\r\n", status: parseRequestStatusBadRequest},
+		{name: `chunk size overflow`, request: post + "Transfer-Encoding: chunked\r\n\r\n123456789\r\n", status: parseRequestStatusBadRequest},
+		{name: `chunk too big`, request: post + "Transfer-Encoding: chunked\r\n\r\nfffff0\r\n", status: parseRequestStatusBadRequest, errorStatus: 413},
+		{name: `no crlf after chunk`, request: post + "Transfer-Encoding: chunked\r\n\r\n5\r\nhelloX\r\n0\r\n\r\n", status: parseRequestStatusBadRequest},
+
+		{name: `trailers`, request: post + "Transfer-Encoding: chunked\r\n\r\n2\r\n{}\r\n0\r\nContent-Encoding: gzip\r\nAuthorization: Bearer x\r\n\r\n", status: parseRequestStatusOk, body: `{}`, keepAlive: true},
+		{name: `bad trailer`, request: post + "Transfer-Encoding: chunked\r\n\r\n0\r\nno colon\r\n\r\n", status: parseRequestStatusBadRequest},
+
+		{name: `cl and te`, request: post + "Content-Length: 5\r\nTransfer-Encoding: chunked\r\n\r\n", status: parseRequestStatusBadRequest},
+		{name: `te and cl 0`, request: post + "Transfer-Encoding: chunked\r\nContent-Length: 0\r\n\r\n", status: parseRequestStatusBadRequest},
+		{name: `te gzip`, request: post + "Transfer-Encoding: gzip\r\n\r\n", status: parseRequestStatusBadRequest, errorStatus: 501},
+		{name: `te chain`, request: post + "Transfer-Encoding: gzip, chunked\r\n\r\n", status: parseRequestStatusBadRequest, errorStatus: 501},
+
+		{name: `expect`, request: post + "Expect: 100-continue\r\nContent-Length: 2\r\n\r\n", status: parseRequestStatusNeedMore, keepAlive: true, expect: true},
+		{name: `expect 1.0`, request: "POST /users/1 HTTP/1.0\r\nExpect: 100-continue\r\nContent-Length: 2\r\n\r\n", status: parseRequestStatusNeedMore},
+		{name: `expect other`, request: post + "Expect: something\r\n\r\n", status: parseRequestStatusBadRequest, errorStatus: 417},
+	}
+
+	var s HTTPServer
+	s.MaxRequestSize = 1 << 20
+
+	for _, test := range tests {
+		for _, split := range []bool{false, true} {
+			parts := []string{test.request}
+			if split {
+				parts = splitBytes(test.request)
+			}
+
+			ctx, status := parseTestRequest(&s, parts...)
+
+			if status != test.status {
+				t.Errorf(`%s (split %v): status %d, want %d`, test.name, split, status, test.status)
+				continue
+			} else if ctx.errorStatus != test.errorStatus {
+				t.Errorf(`%s (split %v): errorStatus %d, want %d`, test.name, split, ctx.errorStatus, test.errorStatus)
+			}
+			if status != parseRequestStatusOk && status != parseRequestStatusNeedMore {
+				continue
+			}
+
+			if string(ctx.Body) != test.body {
+				t.Errorf(`%s (split %v): body %q, want %q`, test.name, split, ctx.Body, test.body)
+			}
+			if ctx.keepAlive != test.keepAlive {
+				t.Errorf(`%s (split %v): keepAlive %v, want %v`, test.name, split, ctx.keepAlive, test.keepAlive)
+			}
+			if ctx.expectContinue != test.expect {
+				t.Errorf(`%s (split %v): expectContinue %v, want %v`, test.name, split, ctx.expectContinue, test.expect)
+			}
+			// трейлеры не должны попадать в заголовки запроса
+			if ctx.RequestHeaders.Has(strContentEncoding) || ctx.RequestHeaders.Has(strAuthorization) {
+				t.Errorf(`%s (split %v): trailer leaked into RequestHeaders`, test.name, split)
+			}
+		}
+	}
+}
+
+func TestParseChunkSize(t *testing.T) {
+	tests := []struct {
+		line string
+		size int
+		ok   bool
+	}{
+		{line: `0`, size: 0, ok: true},
+		{line: `1a`, size: 0x1a, ok: true},
+		{line: `FF`, size: 0xff, ok: true},
+		{line: `10;a=b;c`, size: 0x10, ok: true},
+		{line: `10 `, size: 0x10, ok: true},
+		{line: `ffffffff`, size: 0xffffffff, ok: true},
+		{line: `100000000`, ok: false},
+		{line: ``, ok: false},
+		{line: `;a`, ok: false},
+		{line: `-1`, ok: false},
+		{line: `0x10`, ok: false},
+	}
+
+	for _, test := range tests {
+		size, ok := parseChunkSize([]byte(test.line))
+		if (ok != test.ok) || (ok && (size != test.size)) {
+			t.Errorf(`parseChunkSize(%q) = %d, %v; want %d, %v`, test.line, size, ok, test.size, test.ok)
+		}
+	}
+}
+
+// соединение на socketpair, которое обслуживает lp.serve. второй конец - клиент,
+// read возвращает то, что ему пришло
+func serveTestConn(t *testing.T, s *HTTPServer) (lp *httpLoop, ctx *RequestCtx, client int, read func() string) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		syscall.Close(fds[1])
+	})
+	if err := syscall.SetNonblock(fds[0], true); err != nil {
+		t.Fatal(err)
+	}
+
+	lp = &httpLoop{s: s, l: &httpListener{}, activeCtx: map[int]*RequestCtx{}, now: time.Now().UnixNano()}
+	lp.timers.Init(lp.now)
+
+	ctx = &RequestCtx{}
+	ctx.Reset()
+	ctx.fd = fds[0]
+	ctx.loop = lp
+	lp.activeCtx[ctx.fd] = ctx
+
+	read = func() string {
+		var buf [4096]byte
+		syscall.SetsockoptTimeval(fds[1], syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &syscall.Timeval{Sec: 1})
+		n, err := syscall.Read(fds[1], buf[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(buf[:n])
+	}
+
+	return lp, ctx, fds[1], read
+}
+
+// 100 Continue уходит клиенту, как только заголовки разобраны, а тело читается после него
+func TestServeExpectContinue(t *testing.T) {
+	var body []byte
+	s := &HTTPServer{Handler: func(ctx *RequestCtx) {
+		body = append(body[:0], ctx.Body...)
+		ctx.ResponseBody = emptyResponseBody
+	}}
+	lp, ctx, client, read := serveTestConn(t, s)
+
+	syscall.Write(client, []byte("POST /users/1 HTTP/1.1\r\nExpect: 100-continue\r\nContent-Length: 2\r\n\r\n"))
+	lp.serve(ctx)
+	if got := read(); got != string(responseContinue) {
+		t.Fatalf(`interim response %q, want %q`, got, responseContinue)
+	}
+	if body != nil {
+		t.Fatal(`handler called before body`)
+	}
+
+	syscall.Write(client, []byte("{}"))
+	lp.serve(ctx)
+	if got := read(); !bytes.HasPrefix([]byte(got), []byte("HTTP/1.1 200 OK\r\n")) {
+		t.Fatalf(`response %q`, got)
+	}
+	if string(body) != `{}` {
+		t.Errorf(`body %q`, body)
+	}
+}
+
+// MaxRequestSize ограничивает склеенное chunked тело, а не его вместе со строками размеров
+func TestServeChunkedLimit(t *testing.T) {
+	const limit = 4096
+
+	var body []byte
+	s := &HTTPServer{MaxRequestSize: limit, Handler: func(ctx *RequestCtx) {
+		body = append(body[:0], ctx.Body...)
+		ctx.ResponseBody = emptyResponseBody
+	}}
+
+	const headers = "POST /users/1 HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n"
+
+	// по байту на кусок: со служебными строками это в 6 раз больше limit
+	request := []byte(headers)
+	for i := 0; i < limit-10; i++ {
+		request = append(request, "1\r\nx\r\n"...)
+	}
+	request = append(request, "0\r\n\r\n"...)
+
+	lp, ctx, client, read := serveTestConn(t, s)
+	syscall.Write(client, request)
+	lp.serve(ctx)
+	if got := read(); !bytes.HasPrefix([]byte(got), []byte("HTTP/1.1 200 OK\r\n")) {
+		t.Fatalf(`response %q`, got)
+	}
+	if !bytes.Equal(body, bytes.Repeat([]byte{'x'}, limit-10)) {
+		t.Errorf(`body of %d bytes`, len(body))
+	}
+
+	// тело больше limit и строка размера, которой не хватает места, получают 413, а не молча закрытое соединение
+	tooBig := []byte(headers)
+	for i := 0; i < limit+1; i++ {
+		tooBig = append(tooBig, "1\r\nx\r\n"...)
+	}
+	longLine := []byte(headers + "1;" + strings.Repeat("x", 4*inputBufSize) + "\r\nx\r\n0\r\n\r\n")
+
+	for _, request := range [][]byte{tooBig, longLine} {
+		lp, ctx, client, read := serveTestConn(t, s)
+		syscall.Write(client, request)
+		lp.serve(ctx)
+		if got := read(); !bytes.HasPrefix([]byte(got), []byte("HTTP/1.1 413 ")) {
+			t.Errorf(`response %q to %d bytes, want 413`, got, len(request))
+		}
+	}
+}
+
+// тело в Content-Encoding распаковывается до обработчика, а битое, неизвестное или слишком большое
+// получает ошибку без вызова обработчика
+func TestServeDecompressRequest(t *testing.T) {
+	gzipped := func(data []byte) string {
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		w.Write(data)
+		w.Close()
+		return buf.String()
+	}
+
+	const limit = 1024
+	body := `{"id":1,"email":"a@b.c"}`
+	bomb := gzipped(bytes.Repeat([]byte{'0'}, 100*limit))
+	corrupt := gzipped([]byte(body))
+	corrupt = corrupt[:len(corrupt)/2] + "xxxxxxxx" + corrupt[len(corrupt)/2+8:]
+
+	tests := []struct {
+		name     string
+		encoding string
+		body     string
+		status   string
+	}{
+		{name: `gzip`, encoding: `gzip`, body: gzipped([]byte(body)), status: `200`},
+		{name: `identity`, encoding: `identity`, body: body, status: `200`},
+		{name: `inflates past MaxBodySize`, encoding: `gzip`, body: bomb, status: `413`},
+		{name: `unknown encoding`, encoding: `br`, body: body, status: `415`},
+		{name: `corrupt gzip`, encoding: `gzip`, body: corrupt, status: `400`},
+		{name: `not gzip at all`, encoding: `gzip`, body: body, status: `400`},
+	}
+
+	for _, test := range tests {
+		var got []byte
+		called := false
+		s := &HTTPServer{MaxBodySize: limit, Handler: func(ctx *RequestCtx) {
+			called = true
+			got = append(got[:0], ctx.Body...)
+			if ctx.RequestHeaders.Has(strContentEncoding) {
+				t.Errorf(`%s: handler sees Content-Encoding`, test.name)
+			}
+			ctx.ResponseBody = emptyResponseBody
+		}}
+		lp, ctx, client, read := serveTestConn(t, s)
+
+		syscall.Write(client, []byte("POST /users/1 HTTP/1.1\r\nContent-Encoding: "+test.encoding+
+			"\r\nContent-Length: "+strconv.Itoa(len(test.body))+"\r\n\r\n"+test.body))
+		lp.serve(ctx)
+
+		if response := read(); !strings.HasPrefix(response, "HTTP/1.1 "+test.status+" ") {
+			t.Errorf(`%s: response %q, want %s`, test.name, response, test.status)
+		} else if (test.status == `200`) && (string(got) != body) {
+			t.Errorf(`%s: handler got body %q`, test.name, got)
+		} else if (test.status != `200`) && called {
+			t.Errorf(`%s: handler called`, test.name)
+		}
+	}
+}
+
+// настоящий сервер на unix сокете во временном каталоге. served получит результат ListenAndServe
+func serverTestStart(t *testing.T, s *HTTPServer) (path string, served chan error) {
+	path = filepath.Join(t.TempDir(), `http.sock`)
+	addrs, err := ParseListenAddrs(`unix:` + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	served = make(chan error, 1)
+	go func() {
+		served <- s.ListenAndServe(addrs)
+	}()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		s.Shutdown(ctx)
+	})
+
+	return path, served
+}
+
+func serverTestDial(t *testing.T, path string) net.Conn {
+	var (
+		conn net.Conn
+		err  error
+	)
+	for i := 0; i < 100; i++ {
+		// сервер мог еще не успеть создать сокет
+		if conn, err = net.Dial(`unix`, path); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	return conn
+}
+
+// ответ целиком по Content-Length
+func serverTestResponse(t *testing.T, r *bufio.Reader) (status string, headers string) {
+	status, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	length := 0
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		} else if line == "\r\n" {
+			break
+		}
+		headers += line
+		if strings.HasPrefix(line, `Content-Length: `) {
+			length, _ = strconv.Atoi(strings.TrimSpace(line[len(`Content-Length: `):]))
+		}
+	}
+
+	if _, err := io.ReadFull(r, make([]byte, length)); err != nil {
+		t.Fatal(err)
+	}
+	return status, headers
+}
+
+// соединение сверх MaxConnections получает 503 и закрывается, принятые продолжают работать
+func TestServerMaxConnections(t *testing.T) {
+	const max = 2
+
+	s := &HTTPServer{Listeners: 1, MaxConnections: max, Handler: func(ctx *RequestCtx) {
+		ctx.ResponseBody = emptyResponseBody
+	}}
+	path, _ := serverTestStart(t, s)
+
+	const get = "GET /users/1 HTTP/1.1\r\n\r\n"
+
+	var readers []*bufio.Reader
+	var conns []net.Conn
+	for i := 0; i < max; i++ {
+		conn := serverTestDial(t, path)
+		r := bufio.NewReader(conn)
+		// ответ значит, что соединение принято и посчитано
+		conn.Write([]byte(get))
+		if status, _ := serverTestResponse(t, r); status != "HTTP/1.1 200 OK\r\n" {
+			t.Fatalf(`connection %d: %q`, i, status)
+		}
+		conns, readers = append(conns, conn), append(readers, r)
+	}
+
+	extra := serverTestDial(t, path)
+	response, err := io.ReadAll(extra)
+	if err != nil {
+		t.Fatal(err)
+	} else if string(response) != string(responseTooManyConnections) {
+		t.Errorf(`extra connection got %q`, response)
+	}
+
+	for i, conn := range conns {
+		conn.Write([]byte(get))
+		if status, _ := serverTestResponse(t, readers[i]); status != "HTTP/1.1 200 OK\r\n" {
+			t.Errorf(`connection %d after reject: %q`, i, status)
+		}
+	}
+
+	if total, _ := s.Stats(); (total.Rejected != 1) || (total.Current != max) {
+		t.Errorf(`rejected %d, current %d`, total.Rejected, total.Current)
+	}
+
+	// место освободилось - следующее соединение принимается
+	conns[0].Close()
+	for i := 0; ; i++ {
+		if total, _ := s.Stats(); total.Current < max {
+			break
+		} else if i == 100 {
+			t.Fatal(`closed connection still counted`)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	conn := serverTestDial(t, path)
+	conn.Write([]byte(get))
+	if status, _ := serverTestResponse(t, bufio.NewReader(conn)); status != "HTTP/1.1 200 OK\r\n" {
+		t.Errorf(`connection after close: %q`, status)
+	}
+}
+
+// Shutdown сразу закрывает простаивающее соединение, а начатый запрос дообрабатывает
+// и отвечает на него с Connection: close
+func TestServerShutdownDrain(t *testing.T) {
+	s := &HTTPServer{Listeners: 1, Handler: func(ctx *RequestCtx) {
+		ctx.ResponseBody = append([]byte{}, ctx.Body...)
+	}}
+	path, served := serverTestStart(t, s)
+
+	// тело еще не дослано
+	inflight := serverTestDial(t, path)
+	inflight.Write([]byte("POST /users/1 HTTP/1.1\r\nContent-Length: 2\r\n\r\n"))
+
+	idle := serverTestDial(t, path)
+	idle.Write([]byte("GET /users/1 HTTP/1.1\r\n\r\n"))
+	if status, _ := serverTestResponse(t, bufio.NewReader(idle)); status != "HTTP/1.1 200 OK\r\n" {
+		t.Fatalf(`idle connection: %q`, status)
+	}
+
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdown <- s.Shutdown(ctx)
+	}()
+
+	// простаивающее соединение закрывается без ответа
+	if rest, err := io.ReadAll(idle); (err != nil) || (len(rest) != 0) {
+		t.Errorf(`idle connection: %q, %v; want EOF`, rest, err)
+	}
+
+	select {
+	case err := <-shutdown:
+		t.Fatalf(`Shutdown returned %v before the request finished`, err)
+	default:
+	}
+
+	inflight.Write([]byte("{}"))
+	r := bufio.NewReader(inflight)
+	status, headers := serverTestResponse(t, r)
+	if status != "HTTP/1.1 200 OK\r\n" {
+		t.Errorf(`in-flight request: %q`, status)
+	} else if !strings.Contains(headers, "Connection: close\r\n") {
+		t.Errorf(`no Connection: close in %q`, headers)
+	}
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Errorf(`read after last response: %v, want EOF`, err)
+	}
+
+	if err := <-shutdown; err != nil {
+		t.Errorf(`Shutdown: %v`, err)
+	}
+	if err := <-served; err != nil {
+		t.Errorf(`ListenAndServe: %v`, err)
+	}
+}
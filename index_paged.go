@@ -0,0 +1,216 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+Общая часть индексов пользователей, мест и визитов.
+
+Записи лежат в страницах по pageSize штук, страница выделяется при первом id из ее диапазона.
+Чтобы редкие id не выделяли страницы целиком, новая страница разрешена только:
+	- в диапазоне загруженных данных (до loadedMaxId);
+	- сразу за предыдущей страницей, заполненной хотя бы наполовину.
+Остальные id и все id не меньше indexPagedMaxId живут в map.
+
+Адреса записей постоянны (на них ссылаются кеши): страницы не переезжают, а записи из map
+в выделенную позже страницу не переносятся.
+*/
+
+const (
+	indexPagedMaxId = 64 * 1024 * 1024 // id выше всегда в map
+)
+
+type (
+	pagedIndex[E any, P pagedEntity[E]] struct {
+		pageSize    int32
+		loadedMaxId int32 // до него страницы выделяются без проверки плотности
+		pages       []*indexPage[E]
+		extra       map[int32]P
+		count       int64
+		rwLock      sync.RWMutex
+	}
+
+	indexPage[E any] struct {
+		items []E
+		count int32
+	}
+
+	pagedEntity[E any] interface {
+		*E
+		entityId() int32
+		setVersion(version uint64)
+	}
+)
+
+func (pi *pagedIndex[E, P]) init(pageSize int32) {
+	pi.pageSize = pageSize
+	// пока данные грузятся, им доверяем целиком
+	pi.loadedMaxId = indexPagedMaxId
+	pi.extra = make(map[int32]P)
+}
+
+// после загрузки данных: страницы дальше maxId выделяются только при плотном заполнении
+func (pi *pagedIndex[E, P]) SetLoadedMaxId(maxId int32) {
+	pi.rwLock.Lock()
+	defer pi.rwLock.Unlock()
+
+	pi.loadedMaxId = maxId
+	if pi.loadedMaxId > indexPagedMaxId {
+		pi.loadedMaxId = indexPagedMaxId
+	}
+
+	if pages := int(pi.loadedMaxId/pi.pageSize) + 1; pages > cap(pi.pages) {
+		grown := make([]*indexPage[E], len(pi.pages), pages)
+		copy(grown, pi.pages)
+		pi.pages = grown
+	}
+}
+
+// запись с id или nil. вызывать под rwLock
+func (pi *pagedIndex[E, P]) find(id int32) P {
+	if id <= 0 {
+		return nil
+	}
+
+	if id < indexPagedMaxId {
+		if page := int(id / pi.pageSize); (page < len(pi.pages)) && (pi.pages[page] != nil) {
+			if entity := P(&pi.pages[page].items[id%pi.pageSize]); entity.entityId() == id {
+				return entity
+			}
+		}
+	}
+
+	return pi.extra[id]
+}
+
+// можно ли выделить страницу page. вызывать под rwLock.Lock
+func (pi *pagedIndex[E, P]) pageAllowed(page int) bool {
+	if page <= int(pi.loadedMaxId/pi.pageSize) {
+		return true
+	}
+
+	prev := page - 1
+	return (prev < len(pi.pages)) && (pi.pages[prev] != nil) && (pi.pages[prev].count >= pi.pageSize/2)
+}
+
+func (pi *pagedIndex[E, P]) Add(entity P) bool {
+	id := entity.entityId()
+	if id <= 0 {
+		return false
+	}
+
+	pi.rwLock.Lock()
+	defer pi.rwLock.Unlock()
+
+	if pi.find(id) != nil {
+		return false
+	}
+
+	var slot P
+
+	page := int(id / pi.pageSize)
+	if (id < indexPagedMaxId) && (((page < len(pi.pages)) && (pi.pages[page] != nil)) || pi.pageAllowed(page)) {
+		if page >= len(pi.pages) {
+			// растет только список страниц
+			pages := make([]*indexPage[E], page+1, 2*(page+1))
+			copy(pages, pi.pages)
+			pi.pages = pages
+		}
+		if pi.pages[page] == nil {
+			pi.pages[page] = &indexPage[E]{items: make([]E, pi.pageSize)}
+		}
+
+		pi.pages[page].count++
+		slot = &pi.pages[page].items[id%pi.pageSize]
+	} else {
+		slot = new(E)
+		pi.extra[id] = slot
+	}
+
+	*slot = *entity
+	slot.setVersion(dbNextVersion())
+	atomic.AddInt64(&pi.count, 1)
+
+	return true
+}
+
+func (pi *pagedIndex[E, P]) Get(id int32) P {
+	pi.rwLock.RLock()
+	entity := pi.find(id)
+	pi.rwLock.RUnlock()
+	return entity
+}
+
+func (pi *pagedIndex[E, P]) Delete(id int32) bool {
+	pi.rwLock.Lock()
+	defer pi.rwLock.Unlock()
+
+	entity := pi.find(id)
+	if entity == nil {
+		return false
+	}
+
+	if _, ok := pi.extra[id]; ok {
+		delete(pi.extra, id)
+	} else {
+		pi.pages[id/pi.pageSize].count--
+	}
+
+	var empty E
+	*entity = empty
+	atomic.AddInt64(&pi.count, -1)
+
+	return true
+}
+
+// количество записей в индексе
+func (pi *pagedIndex[E, P]) Count() int64 {
+	return atomic.LoadInt64(&pi.count)
+}
+
+// обход всех записей по возрастанию id. cb возвращает false для прерывания обхода
+func (pi *pagedIndex[E, P]) ForEach(cb func(entity P) bool) {
+	pi.rwLock.RLock()
+	defer pi.rwLock.RUnlock()
+
+	extraIds := make([]int32, 0, len(pi.extra))
+	for id := range pi.extra {
+		extraIds = append(extraIds, id)
+	}
+	sort.Slice(extraIds, func(i, j int) bool { return extraIds[i] < extraIds[j] })
+
+	// записи из map могут попадать и в диапазон страниц
+	emitExtra := func(below int32) bool {
+		for (len(extraIds) > 0) && (extraIds[0] < below) {
+			if !cb(pi.extra[extraIds[0]]) {
+				return false
+			}
+			extraIds = extraIds[1:]
+		}
+		return true
+	}
+
+	for pageIdx, page := range pi.pages {
+		if page == nil {
+			continue
+		}
+
+		for i := range page.items {
+			id := int32(pageIdx)*pi.pageSize + int32(i)
+			if entity := P(&page.items[i]); (id > 0) && (entity.entityId() == id) {
+				if !emitExtra(id) || !cb(entity) {
+					return
+				}
+			}
+		}
+	}
+
+	for _, id := range extraIds {
+		if !cb(pi.extra[id]) {
+			return
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestPagedIndexSparseIds(t *testing.T) {
+	idx := MakeIndexVisit()
+	idx.SetLoadedMaxId(100)
+
+	tests := []struct {
+		id    int32
+		ok    bool
+		paged bool
+	}{
+		{id: 0, ok: false},
+		{id: -5, ok: false},
+		{id: 1, ok: true, paged: true},
+		{id: 100, ok: true, paged: true},
+		{id: 100, ok: false, paged: true},                   // дубль
+		{id: visitsPageSize + 1, ok: true, paged: false},    // предыдущая страница почти пуста
+		{id: 1000 * visitsPageSize, ok: true, paged: false}, // далеко за загруженными данными
+		{id: indexPagedMaxId + 1, ok: true, paged: false},
+		{id: 1<<31 - 1, ok: true, paged: false},
+	}
+
+	for _, test := range tests {
+		if ok := idx.Add(&Visit{Id: test.id}); ok != test.ok {
+			t.Errorf(`Add(%d) = %v, want %v`, test.id, ok, test.ok)
+			continue
+		} else if !test.ok {
+			continue
+		}
+
+		_, inExtra := idx.extra[test.id]
+		if inExtra == test.paged {
+			t.Errorf(`id %d: paged %v, want %v`, test.id, !inExtra, test.paged)
+		}
+		if v := idx.Get(test.id); (v == nil) || (v.Id != test.id) || (v.Version == 0) {
+			t.Errorf(`Get(%d) = %+v`, test.id, v)
+		}
+	}
+
+	if len(idx.pages) != 1 {
+		t.Errorf(`pages %d, want 1`, len(idx.pages))
+	}
+	if idx.Count() != 6 {
+		t.Errorf(`Count %d, want 6`, idx.Count())
+	}
+}
+
+func TestPagedIndexDenseGrowth(t *testing.T) {
+	idx := MakeIndexUser()
+	idx.SetLoadedMaxId(1)
+
+	// первая страница заполнена наполовину - следующая выделяется
+	for id := int32(1); id < usersPageSize/2+1; id++ {
+		if !idx.Add(&User{Id: id}) {
+			t.Fatalf(`Add(%d) fail`, id)
+		}
+	}
+	if !idx.Add(&User{Id: usersPageSize + 7}) {
+		t.Fatal(`Add fail`)
+	}
+	if _, ok := idx.extra[usersPageSize+7]; ok {
+		t.Error(`id after half-filled page went to map`)
+	}
+
+	// а через страницу - уже нет
+	if !idx.Add(&User{Id: 3*usersPageSize + 7}) {
+		t.Fatal(`Add fail`)
+	}
+	if _, ok := idx.extra[3*usersPageSize+7]; !ok {
+		t.Error(`id after empty page went to pages`)
+	}
+}
+
+func TestPagedIndexForEachDelete(t *testing.T) {
+	idx := MakeIndexLocation()
+	idx.SetLoadedMaxId(10)
+
+	for _, id := range []int32{5, locationsPageSize + 3, 2, 1 << 30, 9} {
+		idx.Add(&Location{Id: id})
+	}
+
+	if !idx.Delete(9) || idx.Delete(9) || idx.Delete(1234) {
+		t.Error(`Delete result mismatch`)
+	}
+	if !idx.Delete(1 << 30) {
+		t.Error(`Delete from map fail`)
+	}
+	if idx.Get(9) != nil || idx.Get(1<<30) != nil {
+		t.Error(`deleted entity found`)
+	}
+
+	// id из map после выделения страницы под ее диапазон
+	idx.SetLoadedMaxId(locationsPageSize * 2)
+	idx.Add(&Location{Id: locationsPageSize + 1})
+
+	var ids []int32
+	idx.ForEach(func(location *Location) bool {
+		ids = append(ids, location.Id)
+		return true
+	})
+
+	want := []int32{2, 5, locationsPageSize + 1, locationsPageSize + 3}
+	if len(ids) != len(want) {
+		t.Fatalf(`ForEach %v, want %v`, ids, want)
+	}
+	for i := range want {
+		if ids[i] != want[i] {
+			t.Fatalf(`ForEach %v, want %v`, ids, want)
+		}
+	}
+}
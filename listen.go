@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+/*
+Адреса для HTTPServer.ListenAndServe:
+
+	:80                         все IPv4 адреса (как раньше с -port)
+	127.0.0.1:80                конкретный IPv4
+	[::]:80                     все IPv6 и IPv4 адреса (dual-stack)
+	[::1]:80                    конкретный IPv6
+	unix:/run/hlc.sock?mode=660 unix сокет с правами (восьмеричными)
+	tls::443, tls:[::]:443      любой из адресов выше с TLS (нужен HTTPServer.TLSConfig)
+
+Для TCP на каждый адрес создается HTTPServer.Listeners сокетов с SO_REUSEPORT и своими epoll горутинами.
+Для unix сокета SO_REUSEPORT не работает, поэтому на него ровно одна горутина.
+*/
+
+const (
+	listenNetworkTCP4 = `tcp4`
+	listenNetworkTCP6 = `tcp6`
+	listenNetworkUnix = `unix`
+
+	listenUnixPrefix = `unix:`
+	listenTLSPrefix  = `tls:`
+)
+
+type (
+	ListenAddr struct {
+		Network string // tcp4, tcp6 или unix
+		IP      net.IP
+		Port    int
+		Path    string      // путь к unix сокету
+		Mode    os.FileMode // права на unix сокет, 0 - по umask
+		TLS     bool
+	}
+)
+
+func (a ListenAddr) String() string {
+	prefix := ``
+	if a.TLS {
+		prefix = listenTLSPrefix
+	}
+
+	if a.Network == listenNetworkUnix {
+		return prefix + listenUnixPrefix + a.Path
+	}
+	return prefix + net.JoinHostPort(a.IP.String(), strconv.Itoa(a.Port))
+}
+
+// можно ли раздать адрес нескольким epoll горутинам через SO_REUSEPORT
+func (a ListenAddr) reusePort() bool {
+	return a.Network != listenNetworkUnix
+}
+
+// список адресов через запятую
+func ParseListenAddrs(list string) ([]ListenAddr, error) {
+	var addrs []ListenAddr
+
+	for _, item := range strings.Split(list, `,`) {
+		if item = strings.TrimSpace(item); item == `` {
+			continue
+		}
+
+		addr, err := ParseListenAddr(item)
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, addr)
+	}
+
+	if len(addrs) == 0 {
+		return nil, errors.New(`empty listen address list`)
+	}
+
+	return addrs, nil
+}
+
+func ParseListenAddr(s string) (ListenAddr, error) {
+	if strings.HasPrefix(s, listenTLSPrefix) {
+		addr, err := ParseListenAddr(s[len(listenTLSPrefix):])
+		if err != nil {
+			return ListenAddr{}, err
+		} else if addr.TLS {
+			return ListenAddr{}, fmt.Errorf(`duplicate tls: in listen address %q`, s)
+		}
+		addr.TLS = true
+		return addr, nil
+	}
+
+	if strings.HasPrefix(s, listenUnixPrefix) {
+		return parseListenUnix(s)
+	}
+
+	host, portStr, err := net.SplitHostPort(s)
+	if err != nil {
+		return ListenAddr{}, err
+	}
+
+	port, err := strconv.Atoi(portStr)
+	if err != nil || (port <= 0) || (port > 65535) {
+		return ListenAddr{}, fmt.Errorf(`bad port in listen address %q`, s)
+	}
+
+	if host == `` {
+		return ListenAddr{Network: listenNetworkTCP4, IP: net.IPv4zero, Port: port}, nil
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		// резолвить имена при старте не хочется: адрес должен быть однозначным
+		return ListenAddr{}, fmt.Errorf(`listen address %q must be an IP, not a host name`, s)
+	} else if ip4 := ip.To4(); (ip4 != nil) && !strings.Contains(host, `:`) {
+		return ListenAddr{Network: listenNetworkTCP4, IP: ip4, Port: port}, nil
+	}
+
+	return ListenAddr{Network: listenNetworkTCP6, IP: ip, Port: port}, nil
+}
+
+// unix:/path/to.sock?mode=0660
+func parseListenUnix(s string) (ListenAddr, error) {
+	path := s[len(listenUnixPrefix):]
+	addr := ListenAddr{Network: listenNetworkUnix, Path: path}
+
+	if idx := strings.IndexByte(path, '?'); idx != -1 {
+		addr.Path = path[:idx]
+
+		query, err := url.ParseQuery(path[idx+1:])
+		if err != nil {
+			return ListenAddr{}, err
+		}
+
+		for key := range query {
+			if key != `mode` {
+				return ListenAddr{}, fmt.Errorf(`unknown option %q in listen address %q`, key, s)
+			}
+		}
+
+		if modeStr := query.Get(`mode`); modeStr != `` {
+			mode, err := strconv.ParseUint(modeStr, 8, 32)
+			if (err != nil) || (mode > 0777) {
+				return ListenAddr{}, fmt.Errorf(`bad mode in listen address %q`, s)
+			}
+			addr.Mode = os.FileMode(mode)
+		}
+	}
+
+	if addr.Path == `` {
+		return ListenAddr{}, errors.New(`empty unix socket path`)
+	}
+
+	return addr, nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestParseListenAddr(t *testing.T) {
+	tests := []struct {
+		addr    string
+		ok      bool
+		network string
+		ip      string
+		port    int
+		path    string
+		mode    os.FileMode
+		tls     bool
+		str     string
+	}{
+		{addr: `:80`, ok: true, network: listenNetworkTCP4, ip: `0.0.0.0`, port: 80, str: `0.0.0.0:80`},
+		{addr: `127.0.0.1:8080`, ok: true, network: listenNetworkTCP4, ip: `127.0.0.1`, port: 8080, str: `127.0.0.1:8080`},
+		{addr: `[::]:80`, ok: true, network: listenNetworkTCP6, ip: `::`, port: 80, str: `[::]:80`},
+		{addr: `[::1]:443`, ok: true, network: listenNetworkTCP6, ip: `::1`, port: 443, str: `[::1]:443`},
+		{addr: `[::ffff:127.0.0.1]:80`, ok: true, network: listenNetworkTCP6, ip: `127.0.0.1`, port: 80},
+		{addr: `unix:/run/hlc.sock`, ok: true, network: listenNetworkUnix, path: `/run/hlc.sock`, str: `unix:/run/hlc.sock`},
+		{addr: `unix:/run/hlc.sock?mode=660`, ok: true, network: listenNetworkUnix, path: `/run/hlc.sock`, mode: 0660},
+		{addr: `tls::443`, ok: true, network: listenNetworkTCP4, ip: `0.0.0.0`, port: 443, tls: true, str: `tls:0.0.0.0:443`},
+		{addr: `tls:[::]:443`, ok: true, network: listenNetworkTCP6, ip: `::`, port: 443, tls: true},
+		{addr: `tls:unix:/run/hlc.sock`, ok: true, network: listenNetworkUnix, path: `/run/hlc.sock`, tls: true, str: `tls:unix:/run/hlc.sock`},
+
+		{addr: `tls:tls::443`},
+		{addr: `80`},
+		{addr: `:0`},
+		{addr: `:65536`},
+		{addr: `:http`},
+		{addr: `localhost:80`},
+		{addr: `[::1]`},
+		{addr: `unix:`},
+		{addr: `unix:?mode=600`},
+		{addr: `unix:/run/hlc.sock?mode=999`},
+		{addr: `unix:/run/hlc.sock?mode=1777`},
+		{addr: `unix:/run/hlc.sock?owner=root`},
+	}
+
+	for _, test := range tests {
+		addr, err := ParseListenAddr(test.addr)
+		if (err == nil) != test.ok {
+			t.Errorf(`ParseListenAddr(%q): err %v, want ok=%v`, test.addr, err, test.ok)
+			continue
+		} else if !test.ok {
+			continue
+		}
+
+		if (addr.Network != test.network) || (addr.Port != test.port) || (addr.Path != test.path) || (addr.Mode != test.mode) || (addr.TLS != test.tls) {
+			t.Errorf(`ParseListenAddr(%q) = %+v`, test.addr, addr)
+		}
+		if (test.ip != ``) && (addr.IP.String() != test.ip) {
+			t.Errorf(`ParseListenAddr(%q): ip %s, want %s`, test.addr, addr.IP, test.ip)
+		}
+		if (test.str != ``) && (addr.String() != test.str) {
+			t.Errorf(`ParseListenAddr(%q).String() = %q, want %q`, test.addr, addr.String(), test.str)
+		}
+	}
+}
+
+func TestParseListenAddrs(t *testing.T) {
+	addrs, err := ParseListenAddrs(` :80, [::1]:81 ,,unix:/tmp/a.sock`)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(addrs) != 3 {
+		t.Fatalf(`%d addrs, want 3`, len(addrs))
+	}
+
+	for _, list := range []string{``, ` , `, `:80,:http`} {
+		if _, err := ParseListenAddrs(list); err == nil {
+			t.Errorf(`ParseListenAddrs(%q): no error`, list)
+		}
+	}
+}
+
+// остатки упавшего процесса удаляются, а сокет живого сервера - нет
+func TestSocketRemoveStaleUnix(t *testing.T) {
+	dir := t.TempDir()
+
+	bindUnix := func(path string, listen bool) int {
+		fd, err := syscall.Socket(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := syscall.Bind(fd, &syscall.SockaddrUnix{Name: path}); err != nil {
+			t.Fatal(err)
+		}
+		if listen {
+			if err := syscall.Listen(fd, 1); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return fd
+	}
+
+	if err := socketRemoveStaleUnix(filepath.Join(dir, `missing.sock`)); err != nil {
+		t.Errorf(`missing: %v`, err)
+	}
+
+	stale := filepath.Join(dir, `stale.sock`)
+	syscall.Close(bindUnix(stale, true))
+	if err := socketRemoveStaleUnix(stale); err != nil {
+		t.Errorf(`stale: %v`, err)
+	} else if _, err := os.Lstat(stale); !os.IsNotExist(err) {
+		t.Error(`stale socket not removed`)
+	}
+
+	live := filepath.Join(dir, `live.sock`)
+	fd := bindUnix(live, true)
+	defer syscall.Close(fd)
+	if err := socketRemoveStaleUnix(live); err == nil {
+		t.Error(`live: no error`)
+	} else if _, err := os.Lstat(live); err != nil {
+		t.Errorf(`live socket removed: %v`, err)
+	}
+
+	regular := filepath.Join(dir, `regular`)
+	if err := os.WriteFile(regular, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := socketRemoveStaleUnix(regular); err == nil {
+		t.Error(`regular file: no error`)
+	}
+}
@@ -13,6 +13,7 @@ type (
 		CountryIdx int32
 		City       []byte
 		Distance   int32
+		Version    uint64 // растет при каждом изменении, отдается как ETag
 
 		cache LocationsAvg
 	}
@@ -24,6 +25,7 @@ func (l *Location) Reset() {
 	l.CountryIdx = 0
 	l.City = l.City[:0]
 	l.Distance = 0
+	l.Version = 0
 	l.cache.locations = l.cache.locations[:0]
 }
 
@@ -143,6 +145,8 @@ func (l *Location) Update(update *Location) bool {
 		l.cacheUpdateDistanceAndCountryIdxAndPlace()
 	}
 
+	l.Version = dbNextVersion()
+
 	return true
 }
 
@@ -171,3 +175,11 @@ func (l *Location) cacheUpdateDistanceAndCountryIdxAndPlace() {
 		}
 	}
 }
+
+func (l *Location) entityId() int32 {
+	return l.Id
+}
+
+func (l *Location) setVersion(version uint64) {
+	l.Version = version
+}
@@ -37,7 +37,7 @@ func (la *LocationsAvg) Add(location *Location, visit *Visit, user *User) bool {
 	return true
 }
 
-func (la *LocationsAvg) MoveByVisitId(target *Location, visitId int32) bool {
+func (la *LocationsAvg) RemoveByVisitId(visitId int32) (item LocationAvg, ok bool) {
 	currentPos := -1
 	for i, laItem := range la.locations {
 		if laItem.visitId == visitId {
@@ -46,10 +46,10 @@ func (la *LocationsAvg) MoveByVisitId(target *Location, visitId int32) bool {
 		}
 	}
 	if currentPos == -1 {
-		return false
+		return item, false
 	}
 
-	bak := la.locations[currentPos]
+	item = la.locations[currentPos]
 
 	lastIdx := len(la.locations) - 1
 	if currentPos < lastIdx {
@@ -57,6 +57,15 @@ func (la *LocationsAvg) MoveByVisitId(target *Location, visitId int32) bool {
 	}
 	la.locations = la.locations[:lastIdx]
 
+	return item, true
+}
+
+func (la *LocationsAvg) MoveByVisitId(target *Location, visitId int32) bool {
+	bak, ok := la.RemoveByVisitId(visitId)
+	if !ok {
+		return false
+	}
+
 	target.cache.locations = append(target.cache.locations, bak)
 
 	return true
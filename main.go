@@ -4,6 +4,8 @@ import (
 	"archive/zip"
 	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -34,16 +36,72 @@ var (
 	indexVisit    = MakeIndexVisit()
 
 	indexCountry = MakeIndexCountry()
+
+	// все изменения данных (индексы + производные кеши UserVisits и LocationsAvg) идут под dbLock.Lock,
+	// чтение кешей и сериализация сущностей - под dbLock.RLock. так читатели никогда не видят
+	// наполовину перенесенный визит или обновленную лишь частично сущность.
+	// собственные rwLock индексов защищают только их внутреннюю структуру
+	dbLock sync.RWMutex
+
+	// 1 после загрузки данных и прогрева. до этого слушаем порт, но на запросы к данным отвечаем 503
+	serviceReady int32
 )
 
 var (
 	BuildInfo string = ``
 
 	argv struct {
-		port    uint
-		help    bool
-		pprof   bool
-		zipPath string
+		port     uint
+		listen   string
+		help     bool
+		pprof    bool
+		zipPath  string
+		dumpPath string
+		maxConns int
+
+		readHeaderTimeout time.Duration
+		bodyTimeout       time.Duration
+		idleTimeout       time.Duration
+
+		shutdownTimeout time.Duration
+		snapshotPath    string
+
+		adminPort            uint
+		adminListen          string
+		mutexProfileFraction int
+		blockProfileRate     int
+
+		accessLogPath   string
+		accessLogFormat string
+		accessLogSample uint64
+		accessLogBuffer int
+
+		slowThreshold time.Duration
+		slowLogSize   int
+
+		gcMode           string
+		gcPercent        int
+		memoryLimitMB    int64
+		gcRSSWatermarkMB int64
+		gcPhaseFrom      int
+		mlockall         bool
+
+		phaseIdle     time.Duration
+		phaseSnapshot bool
+
+		authToken string
+		rateLimit float64
+		rateBurst int
+
+		maxBodySize int
+
+		compress        bool
+		compressMinSize int
+		compressLevel   int
+
+		tlsCert       string
+		tlsKey        string
+		tlsSelfSigned bool
 	}
 
 	dictStatistics struct {
@@ -59,11 +117,15 @@ var (
 	// текущее время (или реальное, или полученное из архива с данными)
 	timeNow time.Time
 
-	currentPhase int
-
 	buf bytes.Buffer
 
-	queries, prevQPS int64
+	httpServer HTTPServer
+	mainRouter Router // маршруты основного порта
+
+	listenAddrs      []ListenAddr
+	adminListenAddrs []ListenAddr // nil - админского сервера нет
+
+	tlsCerts TLSCertStore
 
 	poolLocation = sync.Pool{
 		New: func() interface{} {
@@ -73,14 +135,52 @@ var (
 )
 
 func init() {
-	flag.UintVar(&argv.port, `port`, 80, `port to listen`)
+	flag.UintVar(&argv.port, `port`, 80, `port to listen on all IPv4 addresses, if -listen is not set`)
+	flag.StringVar(&argv.listen, `listen`, ``, `comma separated addresses to listen: ":80", "127.0.0.1:80", "[::]:80" (IPv4+IPv6), "unix:/path.sock?mode=660", "tls::443" (any of them with TLS)`)
 	flag.BoolVar(&argv.help, `h`, false, `show this help`)
 	flag.BoolVar(&argv.pprof, `pprof`, false, `enable pprof`)
 	flag.StringVar(&argv.zipPath, `zip`, `/tmp/data/data.zip`, `path to zip file`)
-	flag.Parse()
+	flag.StringVar(&argv.dumpPath, `dump`, ``, `dump loaded DB into zip file (same format as -zip) and exit`)
+	flag.IntVar(&argv.maxConns, `max-conns`, 0, `max open client connections, 0 - unlimited`)
+	flag.DurationVar(&argv.readHeaderTimeout, `read-header-timeout`, 5*time.Second, `time to receive request headers, 0 - unlimited`)
+	flag.DurationVar(&argv.bodyTimeout, `body-timeout`, 30*time.Second, `time to receive request body, 0 - unlimited`)
+	flag.DurationVar(&argv.idleTimeout, `idle-timeout`, 120*time.Second, `keep-alive idle and slow response reading timeout, 0 - unlimited`)
+	flag.DurationVar(&argv.shutdownTimeout, `shutdown-timeout`, 5*time.Second, `time to finish in-flight requests on SIGINT/SIGTERM`)
+	flag.StringVar(&argv.snapshotPath, `snapshot`, ``, `dump DB into zip file (same format as -zip) on shutdown`)
+	flag.UintVar(&argv.adminPort, `admin-port`, 0, `port for /admin/*, /debug/*, /metrics and probes. 0 - serve /admin/* and /debug/* on the main port, only with -auth-token`)
+	flag.StringVar(&argv.adminListen, `admin-listen`, ``, `addresses for the admin server in -listen format, overrides -admin-port`)
+	flag.IntVar(&argv.mutexProfileFraction, `mutex-profile-fraction`, 0, `runtime.SetMutexProfileFraction for /debug/pprof/mutex, 0 - off`)
+	flag.IntVar(&argv.blockProfileRate, `block-profile-rate`, 0, `runtime.SetBlockProfileRate (ns) for /debug/pprof/block, 0 - off`)
+	flag.StringVar(&argv.accessLogPath, `access-log`, ``, `access log file, "-" - stdout, empty - disabled`)
+	flag.StringVar(&argv.accessLogFormat, `access-log-format`, `text`, `access log format: text or json`)
+	flag.Uint64Var(&argv.accessLogSample, `access-log-sample`, 1, `log every N-th request (5xx are always logged)`)
+	flag.IntVar(&argv.accessLogBuffer, `access-log-buffer`, accessLogDefaultBuffer, `access log entries waiting to be written, overflow is dropped`)
+	flag.DurationVar(&argv.slowThreshold, `slow-threshold`, 0, `record requests handled longer than this into /admin/slow, 0 - disabled`)
+	flag.IntVar(&argv.slowLogSize, `slow-log-size`, 1000, `how many slow requests /admin/slow keeps`)
+	flag.StringVar(&argv.gcMode, `gc`, memoryGCOff, `GC mode after load: off, percent or limit`)
+	flag.IntVar(&argv.gcPercent, `gc-percent`, 100, `GOGC for -gc=percent`)
+	flag.Int64Var(&argv.memoryLimitMB, `memory-limit-mb`, 0, `soft memory limit for -gc=limit`)
+	flag.Int64Var(&argv.gcRSSWatermarkMB, `gc-rss-watermark-mb`, 0, `run GC in quiet periods when RSS is above this, 0 - disabled`)
+	flag.IntVar(&argv.gcPhaseFrom, `gc-phase-from`, 3, `run GC after each load phase starting from this one, 0 - disabled`)
+	flag.BoolVar(&argv.mlockall, `mlockall`, true, `lock loaded memory with mlockall(MCL_CURRENT)`)
+	flag.DurationVar(&argv.phaseIdle, `phase-idle`, time.Second, `load phase ends after this long without requests`)
+	flag.BoolVar(&argv.phaseSnapshot, `phase-snapshot`, false, `dump DB into -snapshot after each load phase`)
+	flag.StringVar(&argv.authToken, `auth-token`, ``, `require "Authorization: Bearer <token>" for /admin/ and /debug/, empty - no auth (and no /admin/ on the main port)`)
+	flag.Float64Var(&argv.rateLimit, `rate-limit`, 0, `max requests per second for the whole server (429 above it), 0 - unlimited`)
+	flag.IntVar(&argv.rateBurst, `rate-burst`, 100, `requests allowed above -rate-limit in a burst`)
+	flag.IntVar(&argv.maxBodySize, `max-body-size`, 0, `max request body size after Content-Encoding decompression (413 above it), 0 - same as the request size limit`)
+	flag.BoolVar(&argv.compress, `compress`, false, `gzip/deflate responses for clients with Accept-Encoding`)
+	flag.IntVar(&argv.compressMinSize, `compress-min-size`, 1024, `don't compress responses shorter than this`)
+	flag.IntVar(&argv.compressLevel, `compress-level`, gzip.DefaultCompression, `compression level: 1 (speed) - 9 (size), -1 - default`)
+	flag.StringVar(&argv.tlsCert, `tls-cert`, ``, `PEM certificate (chain) for tls: addresses, reloaded on SIGHUP`)
+	flag.StringVar(&argv.tlsKey, `tls-key`, ``, `PEM private key for -tls-cert`)
+	flag.BoolVar(&argv.tlsSelfSigned, `tls-self-signed`, false, `use generated self-signed certificate for localhost instead of -tls-cert`)
 }
 
 func main() {
+	// не в init, иначе go test не дойдет до своих флагов
+	flag.Parse()
+
 	if argv.help {
 		fmt.Printf("Builded from %s\n", BuildInfo)
 		flag.Usage()
@@ -89,27 +189,109 @@ func main() {
 
 	log.Printf("Started on %d CPUs\n", runtime.NumCPU())
 
-	srv := HTTPServer{
-		Handler: requestHandler,
+	if err := memoryCheckArgs(); err != nil {
+		log.Fatalln(err)
+	}
+
+	if err := listenCheckArgs(); err != nil {
+		log.Fatalln(err)
+	}
+
+	if err := tlsCheckArgs(); err != nil {
+		log.Fatalln(err)
+	}
+
+	httpServer.Handler = Chain(requestHandler, serverMiddlewares(false)...)
+	httpServer.MaxConnections = int32(argv.maxConns)
+	httpServer.ReadHeaderTimeout = argv.readHeaderTimeout
+	httpServer.BodyTimeout = argv.bodyTimeout
+	httpServer.IdleTimeout = argv.idleTimeout
+	httpServer.MaxBodySize = argv.maxBodySize
+
+	if argv.compress {
+		if err := compressCheckArgs(argv.compressLevel); err != nil {
+			log.Fatalln(`Bad -compress-level:`, err)
+		}
+		httpServer.Compression = &CompressOptions{MinSize: argv.compressMinSize, Level: argv.compressLevel}
+	}
+
+	if argv.slowThreshold > 0 {
+		slowLog.Init(argv.slowLogSize)
+	}
+
+	if argv.accessLogPath != `` {
+		var w io.Writer = os.Stdout
+		if argv.accessLogPath != `-` {
+			fd, err := os.OpenFile(argv.accessLogPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+			if err != nil {
+				log.Fatalf(`open access log fail: %s`, err)
+			}
+			defer fd.Close()
+			w = fd
+		}
+
+		httpServer.AccessLog = NewAccessLog(w, argv.accessLogBuffer)
+		httpServer.AccessLog.JSON = argv.accessLogFormat == `json`
+		if argv.accessLogSample > 1 {
+			httpServer.AccessLog.Sample = argv.accessLogSample
+		}
 	}
 
 	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
 	debug.SetGCPercent(100)
 
+	runtime.SetMutexProfileFraction(argv.mutexProfileFraction)
+	runtime.SetBlockProfileRate(argv.blockProfileRate)
+
 	determineCurrentTime()
 
+	registerRoutes()
+
+	if argv.dumpPath == `` {
+		// порт слушаем уже во время загрузки, чтобы оркестратор видел /healthz.
+		// пока serviceReady не выставлен, запросы к данным получают 503
+		go func() {
+			if err := httpServer.ListenAndServe(listenAddrs); (err != nil) && (err != ErrServerClosed) {
+				log.Fatalf(`ListenAndServe fail: %s`, err)
+			}
+		}()
+
+		if adminListenAddrs != nil {
+			registerAdminRoutes()
+			adminServer.Handler = Chain(adminRequestHandler, serverMiddlewares(true)...)
+			adminServer.Listeners = 1
+			go func() {
+				if err := adminServer.ListenAndServe(adminListenAddrs); (err != nil) && (err != ErrServerClosed) {
+					log.Fatalf(`admin ListenAndServe fail: %s`, err)
+				}
+			}()
+		}
+	}
+
 	log.Println(`Load DB...`)
 
 	mt := time.Now().UnixNano()
 	if err := loadDB(); err != nil {
 		log.Fatalf(`load DB fail: %s`, err)
 	}
+	// дальше новые страницы индексов выделяются только под плотно идущие id
+	indexUser.SetLoadedMaxId(dictStatistics.UserMaxId)
+	indexLocation.SetLoadedMaxId(dictStatistics.LocationMaxId)
+	indexVisit.SetLoadedMaxId(dictStatistics.VisitMaxId)
 	dictStatistics.Elapsed = (time.Now().UnixNano() - mt) / int64(time.Millisecond)
 
 	buf.Reset()
 	json.NewEncoder(&buf).Encode(dictStatistics)
 	log.Println(`DB loaded stats:`, string(bytes.TrimSpace(buf.Bytes())))
 
+	if argv.dumpPath != `` {
+		if err := exportDBToFile(argv.dumpPath); err != nil {
+			log.Fatalf(`dump DB fail: %s`, err)
+		}
+		log.Println(`DB dumped into`, argv.dumpPath)
+		return
+	}
+
 	if argv.pprof {
 		if fd, err := os.Create(`pprof.cpu`); err == nil {
 			pprof.StartCPUProfile(fd)
@@ -129,130 +311,342 @@ func main() {
 
 	warming()
 
-	go func() {
-		for {
-			time.Sleep(1 * time.Second)
-			qps := atomic.SwapInt64(&queries, 0)
-			endPhase := (qps == 0) && (prevQPS != 0)
-			newPhase := (qps != 0) && (prevQPS == 0)
-			prevQPS = qps
-
-			if endPhase {
-				if currentPhase >= 3 {
-					gcFrom := time.Now()
-					runtime.GC()
-					gcElapsed := time.Now().Sub(gcFrom)
-
-					log.Printf("Phase ended. Goroutines: %d GC elapsed (ms): %d RSS: %dMB GC pauses (ms): %s\n",
-						runtime.NumGoroutine(),
-						int64(gcElapsed/time.Millisecond),
-						getRSSMemory()/1024/1024,
-						getGCStats(),
-					)
-				} else {
-					log.Printf("Phase ended. RSS: %dMB\n",
-						getRSSMemory()/1024/1024,
-					)
-				}
-			} else if newPhase {
-				currentPhase++
-				log.Println(`Phase`, currentPhase, `started`)
-			}
-		}
-	}()
-
-	go func() {
-		if err := srv.ListenAndServe(int(argv.port)); err != nil {
-			log.Fatalf(`ListenAndServe fail: %s`, err)
-		}
-	}()
+	phaseDetector.IdleTimeout = argv.phaseIdle
+	phaseDetector.Subscribe(phaseLogSubscriber)
+	phaseDetector.Subscribe(memoryPolicy.OnPhaseEvent)
+	if argv.phaseSnapshot && (argv.snapshotPath != ``) {
+		phaseDetector.Subscribe(phaseSnapshotSubscriber)
+	}
+	go phaseDetector.Run()
 
-	runtime.GC()
-	debug.SetGCPercent(-1)
+	memoryDesc := memoryApply()
 
-	mlockallErr := syscall.Mlockall(syscall.MCL_CURRENT)
+	atomic.StoreInt32(&serviceReady, 1)
 
-	log.Printf("Ready for work. Build: %s. RSS:% dMB. GC pauses before (ms): %s. GC disabled. mlockall: %s\n",
+	log.Printf("Ready for work. Build: %s. RSS:% dMB. GC pauses before (ms): %s. %s\n",
 		BuildInfo,
 		getRSSMemory()/1024/1024,
 		getGCStats(),
-		mlockallErr,
+		memoryDesc,
 	)
 
 	ch := make(chan os.Signal, 10)
-	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
-	<-ch
+	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range ch {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		tlsReload()
+	}
+
+	log.Println(`Shutting down...`)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), argv.shutdownTimeout)
+	if err := httpServer.Shutdown(shutdownCtx); err != nil {
+		log.Println(`Shutdown:`, err)
+	}
+	if err := adminServer.Shutdown(shutdownCtx); err != nil {
+		log.Println(`admin Shutdown:`, err)
+	}
+	cancel()
+
+	if httpServer.AccessLog != nil {
+		// epoll горутины уже остановлены, новых записей не будет
+		httpServer.AccessLog.Close()
+	}
+
+	if argv.snapshotPath != `` {
+		// снимок после фазы мог еще писаться, этот должен оказаться последним
+		snapshotLock.Lock()
+		err := exportDBToFile(argv.snapshotPath)
+		snapshotLock.Unlock()
+
+		if err != nil {
+			log.Println(`snapshot DB fail:`, err)
+		} else {
+			log.Println(`DB dumped into`, argv.snapshotPath)
+		}
+	}
 
 	log.Printf("Bye. RSS: %dMB GC pauses (ms): %s\n", getRSSMemory()/1024/1024, getGCStats())
 }
 
 func requestHandler(ctx *RequestCtx) {
-	atomic.AddInt64(&queries, 1)
+	started := time.Now()
 
 	req := requestParamsPool.Get().(*RequestParams)
-	defer requestParamsPool.Put(req)
+	req.scanned = 0
+	req.matched = 0
+
+	requestDispatch(ctx, req)
+
+	elapsed := time.Since(started)
+	if (argv.slowThreshold > 0) && (elapsed >= argv.slowThreshold) {
+		slowLog.Record(ctx, req, elapsed)
+	}
+
+	// пробы оркестратора и сбор метрик фазы обстрела не продлевают
+	phaseDetector.Observe(metricsRoute(ctx.Route))
+
+	requestParamsPool.Put(req)
+}
 
+func serverMiddlewares(admin bool) []Middleware {
+	// ErrorLog снаружи Recovery, чтобы 500 после паники тоже попадал в лог
+	middlewares := []Middleware{MetricsMiddleware, RequestIdMiddleware, ErrorLogMiddleware, RecoveryMiddleware}
+
+	if argv.authToken != `` {
+		middlewares = append(middlewares, AuthMiddleware([]byte(argv.authToken), strPathAdmin, strPathDebug))
+	}
+	if (argv.rateLimit > 0) && !admin {
+		// пробы и метрики не должны отваливаться под нагрузкой
+		middlewares = append(middlewares, RateLimitMiddleware(argv.rateLimit, argv.rateBurst,
+			strPathHealthz, strPathReadyz, strPathVersion, strPathMetrics))
+	}
+
+	return middlewares
+}
+
+func requestDispatch(ctx *RequestCtx, req *RequestParams) {
 	if !parseRequest(ctx, req) {
 		ctx.ResponseStatus = 400
 		return
-	} else if req.entity == nil {
-		ctx.ResponseStatus = 400
-		return
 	}
 
-	if !req.isGET && req.isNew {
-		// POST /<entity>/new на создание
-		reqNew(ctx, req)
-	} else if req.id <= 0 {
-		ctx.ResponseStatus = 404
-		return
-	} else if !req.isGET {
-		// POST /<entity>/<id> на обновление
-		reqUpdate(ctx, req)
-	} else if req.action == nil {
-		// GET /<entity>/<id> для получения данных о сущности
-		reqGet(ctx, req)
-	} else if bytes.Equal(req.entity, strUsers) && bytes.Equal(req.action, strVisits) {
-		// GET /users/<id>/visits для получения списка посещений пользователем
-		reqUserVisits(ctx, req)
-	} else if bytes.Equal(req.entity, strLocations) && bytes.Equal(req.action, strAvg) {
-		// GET /locations/<id>/avg для получения средней оценки достопримечательности
-		reqLocationAvg(ctx, req)
+	mainRouter.Dispatch(ctx, req)
+}
+
+// -listen/-port и -admin-listen/-admin-port -> listenAddrs и adminListenAddrs
+func listenCheckArgs() (err error) {
+	listen := argv.listen
+	if listen == `` {
+		listen = fmt.Sprintf(`:%d`, argv.port)
+	}
+	if listenAddrs, err = ParseListenAddrs(listen); err != nil {
+		return fmt.Errorf(`bad -listen: %s`, err)
+	}
+
+	adminListen := argv.adminListen
+	if (adminListen == ``) && (argv.adminPort != 0) {
+		adminListen = fmt.Sprintf(`:%d`, argv.adminPort)
+	}
+	if adminListen != `` {
+		if adminListenAddrs, err = ParseListenAddrs(adminListen); err != nil {
+			return fmt.Errorf(`bad -admin-listen: %s`, err)
+		}
+	}
+
+	return nil
+}
+
+// -tls-cert/-tls-key/-tls-self-signed -> TLSConfig серверов, у которых есть tls: адреса
+func tlsCheckArgs() error {
+	withTLS := func(addrs []ListenAddr) bool {
+		for _, addr := range addrs {
+			if addr.TLS {
+				return true
+			}
+		}
+		return false
+	}
+
+	mainTLS, adminTLS := withTLS(listenAddrs), withTLS(adminListenAddrs)
+	if !mainTLS && !adminTLS {
+		return nil
+	}
+
+	if argv.tlsSelfSigned {
+		cert, err := tlsSelfSignedCert()
+		if err != nil {
+			return fmt.Errorf(`self-signed certificate: %s`, err)
+		}
+		tlsCerts.Set(cert)
+	} else if (argv.tlsCert == ``) || (argv.tlsKey == ``) {
+		return errors.New(`tls: listen address needs -tls-cert and -tls-key (or -tls-self-signed)`)
 	} else {
-		ctx.ResponseStatus = 400
+		tlsCerts.CertFile, tlsCerts.KeyFile = argv.tlsCert, argv.tlsKey
+		if err := tlsCerts.Load(); err != nil {
+			return fmt.Errorf(`load tls certificate: %s`, err)
+		}
+	}
+
+	// конфиг общий: сертификат берется из tlsCerts на каждом рукопожатии
+	config := tlsCerts.Config()
+	if mainTLS {
+		httpServer.TLSConfig = config
+	}
+	if adminTLS {
+		adminServer.TLSConfig = config
+	}
+
+	return nil
+}
+
+// SIGHUP: перечитать сертификат. новые соединения получат его, уже открытые живут со старым
+func tlsReload() {
+	if tlsCerts.CertFile == `` {
 		return
 	}
+
+	if err := tlsCerts.Load(); err != nil {
+		log.Println(`TLS certificate reload fail, keep the old one:`, err)
+	} else {
+		log.Println(`TLS certificate reloaded from`, tlsCerts.CertFile)
+	}
 }
 
-func reqGet(ctx *RequestCtx, req *RequestParams) {
-	// GET /<entity>/<id> для получения данных о сущности
+func registerRoutes() {
+	r := &mainRouter
 
-	if bytes.Equal(req.entity, strUsers) {
-		if user := indexUser.Get(req.id); user == nil {
-			ctx.ResponseStatus = 404
-		} else {
-			ctx.ResponseBody = user.Serialize(ctx.UserBuf[:0])
-		}
-	} else if bytes.Equal(req.entity, strLocations) {
-		if location := indexLocation.Get(req.id); location == nil {
-			ctx.ResponseStatus = 404
+	registerServiceRoutes(r)
+
+	r.Handle(MethodGET, `/users/{id:int}`, metricsRouteUsersGet, requireReady(reqUserGet))
+	r.Handle(MethodGET, `/users/{id:int}/visits`, metricsRouteUsersVisits, requireReady(reqUserVisits))
+	r.Handle(MethodPOST, `/users/new`, metricsRouteUsersNew, requireReady(reqUserNew))
+	r.Handle(MethodPOST, `/users/{id:int}`, metricsRouteUsersUpdate, requireReady(reqUserUpdate))
+
+	r.Handle(MethodGET, `/locations/{id:int}`, metricsRouteLocationsGet, requireReady(reqLocationGet))
+	r.Handle(MethodGET, `/locations/{id:int}/avg`, metricsRouteLocationsAvg, requireReady(reqLocationAvg))
+	r.Handle(MethodPOST, `/locations/new`, metricsRouteLocationsNew, requireReady(reqLocationNew))
+	r.Handle(MethodPOST, `/locations/{id:int}`, metricsRouteLocationsUpdate, requireReady(reqLocationUpdate))
+
+	r.Handle(MethodGET, `/visits/{id:int}`, metricsRouteVisitsGet, requireReady(reqVisitGet))
+	r.Handle(MethodPOST, `/visits/new`, metricsRouteVisitsNew, requireReady(reqVisitNew))
+	r.Handle(MethodPOST, `/visits/{id:int}`, metricsRouteVisitsUpdate, requireReady(reqVisitUpdate))
+
+	r.Handle(MethodPOST, `/tx`, metricsRouteTx, requireReady(reqTx))
+
+	// с админским сервером служебное живет только на нем
+	if adminListenAddrs == nil {
+		if argv.authToken != `` {
+			registerDebugRoutes(r)
+			registerAdminDataRoutes(r)
 		} else {
-			ctx.ResponseBody = location.Serialize(ctx.UserBuf[:0])
+			// выгрузка базы и профили на публичном порту без авторизации недопустимы
+			log.Println(`/admin/* and /debug/* are disabled: set -auth-token or use -admin-port`)
 		}
-	} else if bytes.Equal(req.entity, strVisits) {
-		if visit := indexVisit.Get(req.id); visit == nil {
-			ctx.ResponseStatus = 404
-		} else {
-			ctx.ResponseBody = visit.Serialize(ctx.UserBuf[:0])
+	}
+}
+
+// служебные ручки с данными: только на админском сервере или за -auth-token
+func registerAdminDataRoutes(r *Router) {
+	r.Handle(MethodGET, `/admin/phase`, metricsRouteAdmin, requireReady(reqAdminPhase))
+	r.Handle(MethodGET, `/admin/slow`, metricsRouteAdmin, requireReady(reqAdminSlow))
+	r.Handle(MethodGET, `/admin/export`, metricsRouteAdmin, requireReady(reqAdminExport))
+}
+
+// пробы и метрики. работают и во время загрузки
+func registerServiceRoutes(r *Router) {
+	r.Handle(MethodGET, `/healthz`, metricsRouteProbes, reqHealthz)
+	r.Handle(MethodGET, `/readyz`, metricsRouteProbes, reqReadyz)
+	r.Handle(MethodGET, `/version`, metricsRouteProbes, reqVersion)
+	r.Handle(MethodGET, `/metrics`, metricsRouteMetrics, reqMetrics)
+}
+
+// пока данные грузятся, запросы к ним получают 503
+func requireReady(handler RouteHandler) RouteHandler {
+	return func(ctx *RequestCtx, req *RequestParams) {
+		if atomic.LoadInt32(&serviceReady) == 0 {
+			ctx.ResponseStatus = 503
+			return
 		}
-	} else {
-		ctx.ResponseStatus = 400
+		handler(ctx, req)
+	}
+}
+
+func reqHealthz(ctx *RequestCtx, req *RequestParams) {
+	// GET /healthz - процесс жив и принимает запросы
+	ctx.ResponseBody = emptyResponseBody
+}
+
+func reqReadyz(ctx *RequestCtx, req *RequestParams) {
+	// GET /readyz - данные загружены и прогреты
+	if atomic.LoadInt32(&serviceReady) == 0 {
+		ctx.ResponseStatus = 503
+		return
+	}
+	ctx.ResponseBody = emptyResponseBody
+}
+
+func reqVersion(ctx *RequestCtx, req *RequestParams) {
+	// GET /version
+	if atomic.LoadInt32(&serviceReady) == 0 {
+		// dictStatistics еще заполняется
+		ctx.ResponseStatus = 503
+		return
+	}
+
+	info := struct {
+		Build   string      `json:"build"`
+		Elapsed int64       `json:"elapsed"`
+		TimeNow int64       `json:"time_now"`
+		Stats   interface{} `json:"stats"`
+	}{
+		Build:   BuildInfo,
+		Elapsed: dictStatistics.Elapsed,
+		TimeNow: timeNow.Unix(),
+		Stats:   &dictStatistics,
+	}
+	json.NewEncoder(ctx).Encode(&info)
+}
+
+func reqAdminExport(ctx *RequestCtx, req *RequestParams) {
+	// GET /admin/export для выгрузки всех данных в формате data.zip
+	// копия базы нужна целиком и под одним dbLock.RLock: по частям визиты могли бы сослаться
+	// на пользователей, которых в архиве нет, и loadDB его не примет. копирование идет уже в горутине
+	// StreamAsync, а не в epoll горутине. несжатая копия держится, пока файлы архива не уйдут,
+	// и освобождается по одному файлу. сам архив в памяти не копится: медленный клиент тормозит сжатие
+	ctx.SetContentType(contentTypeZip)
+	ctx.StreamAsync(func(w io.Writer) error {
+		return exportWriteZip(w, exportDBFiles())
+	})
+}
+
+func reqUserGet(ctx *RequestCtx, req *RequestParams) {
+	// GET /users/<id>
+
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+
+	if user := indexUser.Get(req.id); user == nil {
+		ctx.ResponseStatus = 404
+	} else if !checkNotModified(ctx, user.Version) {
+		ctx.ResponseBody = user.Serialize(ctx.UserBuf[:0])
+	}
+}
+
+func reqLocationGet(ctx *RequestCtx, req *RequestParams) {
+	// GET /locations/<id>
+
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+
+	if location := indexLocation.Get(req.id); location == nil {
+		ctx.ResponseStatus = 404
+	} else if !checkNotModified(ctx, location.Version) {
+		ctx.ResponseBody = location.Serialize(ctx.UserBuf[:0])
+	}
+}
+
+func reqVisitGet(ctx *RequestCtx, req *RequestParams) {
+	// GET /visits/<id>
+
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+
+	if visit := indexVisit.Get(req.id); visit == nil {
+		ctx.ResponseStatus = 404
+	} else if !checkNotModified(ctx, visit.Version) {
+		ctx.ResponseBody = visit.Serialize(ctx.UserBuf[:0])
 	}
 }
 
 func reqUserVisits(ctx *RequestCtx, req *RequestParams) {
 	// GET /users/<id>/visits для получения списка посещений пользователем
 
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+
 	user := indexUser.Get(req.id)
 
 	if user == nil {
@@ -271,6 +665,10 @@ func reqUserVisits(ctx *RequestCtx, req *RequestParams) {
 
 	buf = append(buf, `{"visits":[`...)
 
+	// длинные списки отдаются кусками по мере сборки, короткие - как обычно, с Content-Length
+
+	req.scanned = int32(len(user.cache.visits))
+
 	for _, cacheItem := range user.cache.visits {
 		if (fromDate > 0) && (cacheItem.visitedAt <= fromDate) {
 			continue
@@ -282,7 +680,17 @@ func reqUserVisits(ctx *RequestCtx, req *RequestParams) {
 			continue
 		}
 
+		if bufWithData {
+			buf = append(buf, ',')
+		}
 		bufWithData = true
+		req.matched++
+
+		if len(buf) >= streamFlushSize {
+			ctx.StartStream()
+			ctx.Write(buf)
+			buf = buf[:0]
+		}
 
 		buf = append(buf, `{"mark":`...)
 		buf = append(buf, cacheItem.markChar)
@@ -290,21 +698,24 @@ func reqUserVisits(ctx *RequestCtx, req *RequestParams) {
 		buf = append(buf, cacheItem.visitedAtStr[:cacheItem.visitedAtStrLen]...)
 		buf = append(buf, `,"place":"`...)
 		buf = append(buf, cacheItem.place...)
-		buf = append(buf, `"},`...)
-	}
-
-	if bufWithData {
-		buf = buf[:len(buf)-1] // убираю последнюю запятую
+		buf = append(buf, `"}`...)
 	}
 
 	buf = append(buf, `]}`...)
 
-	ctx.ResponseBody = buf
+	if ctx.Streaming() {
+		ctx.Write(buf)
+	} else {
+		ctx.ResponseBody = buf
+	}
 }
 
 func reqLocationAvg(ctx *RequestCtx, req *RequestParams) {
 	// GET /locations/<id>/avg для получения средней оценки достопримечательности
 
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+
 	location := indexLocation.Get(req.id)
 
 	if location == nil {
@@ -327,6 +738,8 @@ func reqLocationAvg(ctx *RequestCtx, req *RequestParams) {
 
 	gender := req.gender
 
+	req.scanned = int32(len(location.cache.locations))
+
 	for _, cacheItem := range location.cache.locations {
 		if (fromDate > 0) && (cacheItem.visitedAt <= fromDate) {
 			continue
@@ -344,6 +757,8 @@ func reqLocationAvg(ctx *RequestCtx, req *RequestParams) {
 		markCnt++
 	}
 
+	req.matched = int32(markCnt)
+
 	if markCnt > 0 {
 		avg = float64(markSum) / float64(markCnt)
 	}
@@ -358,63 +773,24 @@ func reqLocationAvg(ctx *RequestCtx, req *RequestParams) {
 	ctx.ResponseBody = buf
 }
 
-func reqNew(ctx *RequestCtx, req *RequestParams) {
-	// POST /<entity>/new на создание
+func reqUserNew(ctx *RequestCtx, req *RequestParams) {
+	// POST /users/new
 
-	if bytes.Equal(req.entity, strUsers) {
-		var user User
-		if !user.Parse(ctx.Body) {
-			ctx.ResponseStatus = 400
-			return
-		} else if !user.CheckFields(false) {
-			ctx.ResponseStatus = 400
-			return
-		} else if !indexUser.Add(&user) {
-			ctx.ResponseStatus = 400
-			return
-		}
+	var user User
+	if !user.Parse(ctx.Body) {
+		ctx.ResponseStatus = 400
+		return
+	} else if !user.CheckFields(false) {
+		ctx.ResponseStatus = 400
+		return
+	}
 
-	} else if bytes.Equal(req.entity, strLocations) {
-		location := poolLocation.Get().(*Location)
-		location.Reset()
-		if !location.Parse(ctx.Body) {
-			ctx.ResponseStatus = 400
-			poolLocation.Put(location)
-			return
-		} else if !location.CheckFields(false) {
-			ctx.ResponseStatus = 400
-			poolLocation.Put(location)
-			return
-		} else if !indexLocation.Add(location) {
-			ctx.ResponseStatus = 400
-			poolLocation.Put(location)
-			return
-		}
-		// если все хорошо, то не возвращаю location в пул
+	dbLock.Lock()
+	defer dbLock.Unlock()
 
-	} else if bytes.Equal(req.entity, strVisits) {
-		var visit Visit
-		if !visit.Parse(ctx.Body) {
-			ctx.ResponseStatus = 400
-			return
-		} else if !visit.CheckFields(false) {
-			ctx.ResponseStatus = 400
-			return
-		} else if !indexVisit.Add(&visit) {
-			ctx.ResponseStatus = 400
-			return
-		} else if user := indexUser.Get(visit.User); user == nil {
-			ctx.ResponseStatus = 404
-			return
-		} else if location := indexLocation.Get(visit.Location); location == nil {
-			ctx.ResponseStatus = 404
-			return
-		} else {
-			user.cache.Add(location, &visit)
-			location.cache.Add(location, &visit, user)
-		}
+	ok := indexUser.Add(&user)
 
-	} else {
+	if !ok {
 		ctx.ResponseStatus = 400
 		return
 	}
@@ -422,83 +798,165 @@ func reqNew(ctx *RequestCtx, req *RequestParams) {
 	ctx.ResponseBody = emptyResponseBody
 }
 
-func reqUpdate(ctx *RequestCtx, req *RequestParams) {
-	// POST /<entity>/<id> на обновление
+func reqLocationNew(ctx *RequestCtx, req *RequestParams) {
+	// POST /locations/new
 
-	if bytes.Equal(req.entity, strUsers) {
-		var user User
+	location := poolLocation.Get().(*Location)
+	location.Reset()
+	if !location.Parse(ctx.Body) {
+		ctx.ResponseStatus = 400
+		poolLocation.Put(location)
+		return
+	} else if !location.CheckFields(false) {
+		ctx.ResponseStatus = 400
+		poolLocation.Put(location)
+		return
+	}
 
-		if !user.Parse(ctx.Body) {
-			ctx.ResponseStatus = 400
-			return
-		}
+	dbLock.Lock()
+	defer dbLock.Unlock()
 
-		if !user.CheckFields(true) {
-			// 404 приоритетнее, чем 400
-			if indexUser.Get(req.id) == nil {
-				ctx.ResponseStatus = 404
-			} else {
-				ctx.ResponseStatus = 400
-			}
-			return
-		} else if !indexUser.Update(req.id, &user) {
-			ctx.ResponseStatus = 404
-			return
-		}
+	ok := indexLocation.Add(location)
+
+	if !ok {
+		ctx.ResponseStatus = 400
+		poolLocation.Put(location)
+		return
+	}
+	// если все хорошо, то не возвращаю location в пул
 
-	} else if bytes.Equal(req.entity, strLocations) {
-		location := poolLocation.Get().(*Location)
-		location.Reset()
+	ctx.ResponseBody = emptyResponseBody
+}
 
-		if !location.Parse(ctx.Body) {
-			ctx.ResponseStatus = 400
-			poolLocation.Put(location)
-			return
-		}
+func reqVisitNew(ctx *RequestCtx, req *RequestParams) {
+	// POST /visits/new
 
-		if !location.CheckFields(true) {
-			// 404 приоритетнее, чем 400
-			if indexLocation.Get(req.id) == nil {
-				ctx.ResponseStatus = 404
-			} else {
-				ctx.ResponseStatus = 400
-			}
-			poolLocation.Put(location)
-			return
-		} else if !indexLocation.Update(req.id, location) {
-			ctx.ResponseStatus = 404
-			poolLocation.Put(location)
-			return
-		}
-		poolLocation.Put(location)
+	var visit Visit
+	if !visit.Parse(ctx.Body) {
+		ctx.ResponseStatus = 400
+		return
+	} else if !visit.CheckFields(false) {
+		ctx.ResponseStatus = 400
+		return
+	}
 
-	} else if bytes.Equal(req.entity, strVisits) {
-		var visit Visit
+	dbLock.Lock()
+	defer dbLock.Unlock()
 
-		if !visit.Parse(ctx.Body) {
-			ctx.ResponseStatus = 400
-			return
-		}
+	status := storeVisitNew(&visit)
 
-		if !visit.CheckFields(true) {
-			// 404 приоритетнее, чем 400
-			if indexVisit.Get(req.id) == nil {
-				ctx.ResponseStatus = 404
-			} else {
-				ctx.ResponseStatus = 400
-			}
-			return
-		} else if !indexVisit.Update(req.id, &visit) {
-			ctx.ResponseStatus = 404
-			return
-		}
+	if status != 200 {
+		ctx.ResponseStatus = status
+		return
+	}
+
+	ctx.ResponseBody = emptyResponseBody
+}
+
+func reqUserUpdate(ctx *RequestCtx, req *RequestParams) {
+	// POST /users/<id>
+
+	var user User
+
+	if !user.Parse(ctx.Body) {
+		ctx.ResponseStatus = 400
+		return
+	}
 
+	dbLock.Lock()
+	defer dbLock.Unlock()
+
+	// 404 приоритетнее, чем 400
+	if current := indexUser.Get(req.id); current == nil {
+		ctx.ResponseStatus = 404
+	} else if !checkIfMatch(ctx, current.Version) {
+		ctx.ResponseStatus = 412
+	} else if !user.CheckFields(true) {
+		ctx.ResponseStatus = 400
 	} else {
+		current.Update(&user)
+		setETag(ctx, current.Version)
+		ctx.ResponseBody = emptyResponseBody
+	}
+}
+
+func reqLocationUpdate(ctx *RequestCtx, req *RequestParams) {
+	// POST /locations/<id>
+
+	location := poolLocation.Get().(*Location)
+	location.Reset()
+	defer poolLocation.Put(location)
+
+	if !location.Parse(ctx.Body) {
 		ctx.ResponseStatus = 400
 		return
 	}
 
-	ctx.ResponseBody = emptyResponseBody
+	dbLock.Lock()
+	defer dbLock.Unlock()
+
+	// 404 приоритетнее, чем 400
+	if current := indexLocation.Get(req.id); current == nil {
+		ctx.ResponseStatus = 404
+	} else if !checkIfMatch(ctx, current.Version) {
+		ctx.ResponseStatus = 412
+	} else if !location.CheckFields(true) {
+		ctx.ResponseStatus = 400
+	} else {
+		current.Update(location)
+		setETag(ctx, current.Version)
+		ctx.ResponseBody = emptyResponseBody
+	}
+}
+
+func reqVisitUpdate(ctx *RequestCtx, req *RequestParams) {
+	// POST /visits/<id>
+
+	var visit Visit
+
+	if !visit.Parse(ctx.Body) {
+		ctx.ResponseStatus = 400
+		return
+	}
+
+	dbLock.Lock()
+	defer dbLock.Unlock()
+
+	// 404 приоритетнее, чем 400
+	if current := indexVisit.Get(req.id); current == nil {
+		ctx.ResponseStatus = 404
+	} else if !checkIfMatch(ctx, current.Version) {
+		ctx.ResponseStatus = 412
+	} else if !visit.CheckFields(true) {
+		ctx.ResponseStatus = 400
+	} else if status := storeVisitUpdate(req.id, &visit); status != 200 {
+		ctx.ResponseStatus = status
+	} else {
+		setETag(ctx, current.Version)
+		ctx.ResponseBody = emptyResponseBody
+	}
+}
+
+func setETag(ctx *RequestCtx, version uint64) {
+	var tmp [etagMaxLen]byte
+	ctx.ResponseHeaders.Add(strETag, appendETag(tmp[:0], version))
+}
+
+// ETag + If-None-Match для GET. true - сущность не изменилась и тело отдавать не нужно (304)
+func checkNotModified(ctx *RequestCtx, version uint64) bool {
+	setETag(ctx, version)
+
+	if ifNoneMatch := ctx.RequestHeaders.Peek(strIfNoneMatch); (ifNoneMatch != nil) && etagMatch(ifNoneMatch, version, false) {
+		ctx.ResponseStatus = 304
+		return true
+	}
+	return false
+}
+
+// If-Match для POST обновления. false - версия не совпала, ответ 412
+func checkIfMatch(ctx *RequestCtx, version uint64) bool {
+	ifMatch := ctx.RequestHeaders.Peek(strIfMatch)
+	return (ifMatch == nil) || etagMatch(ifMatch, version, true)
 }
 
 func loadDB() error {
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"runtime"
+	"runtime/debug"
+	"syscall"
+	"time"
+)
+
+/*
+Политика работы с памятью после загрузки данных.
+
+Режимы GC (-gc):
+	off     - GC выключен совсем, как требовалось на конкурсе. куча под записью растет без ограничений
+	percent - обычный GOGC=-gc-percent
+	limit   - GC выключен, пока куча не подберется к -memory-limit-mb (мягкий лимит рантайма)
+
+Дополнительно, независимо от режима:
+	-gc-rss-watermark-mb  в паузах между обстрелами GC запускается, если RSS выше отметки
+	-gc-phase-from        принудительный GC по окончании фаз, начиная с этой (0 - выключено)
+	-mlockall             запрет выгрузки уже загруженных страниц в своп
+*/
+
+const (
+	memoryGCOff     = `off`
+	memoryGCPercent = `percent`
+	memoryGCLimit   = `limit`
+)
+
+type (
+	memoryPolicyState struct {
+		quietGCDone bool // GC по RSS в текущей паузе уже был, повторно не запускаем
+	}
+)
+
+var (
+	memoryPolicy memoryPolicyState
+)
+
+func memoryCheckArgs() error {
+	switch argv.gcMode {
+	case memoryGCOff, memoryGCPercent:
+	case memoryGCLimit:
+		if argv.memoryLimitMB <= 0 {
+			return fmt.Errorf(`-gc=%s requires -memory-limit-mb`, memoryGCLimit)
+		}
+	default:
+		return fmt.Errorf(`unknown -gc mode %q`, argv.gcMode)
+	}
+
+	return nil
+}
+
+// применяется после загрузки и прогрева. возвращает описание для лога
+func memoryApply() string {
+	runtime.GC()
+
+	var desc string
+
+	switch argv.gcMode {
+	case memoryGCOff:
+		debug.SetGCPercent(-1)
+		desc = `GC disabled`
+	case memoryGCPercent:
+		debug.SetGCPercent(argv.gcPercent)
+		desc = fmt.Sprintf(`GC percent %d`, argv.gcPercent)
+	case memoryGCLimit:
+		debug.SetGCPercent(-1)
+		debug.SetMemoryLimit(argv.memoryLimitMB * 1024 * 1024)
+		desc = fmt.Sprintf(`GC by memory limit %dMB`, argv.memoryLimitMB)
+	}
+
+	if argv.mlockall {
+		desc += fmt.Sprintf(`. mlockall: %v`, syscall.Mlockall(syscall.MCL_CURRENT))
+	}
+
+	return desc
+}
+
+// подписчик PhaseDetector
+func (m *memoryPolicyState) OnPhaseEvent(ev *PhaseEvent) {
+	switch ev.Kind {
+	case PhaseStart:
+		// следующая пауза снова может запустить GC по RSS
+		m.quietGCDone = false
+	case PhaseEnd:
+		m.phaseEnded(ev.Phase)
+	case PhaseIdle:
+		m.quiet()
+	}
+}
+
+// на каждом тике без запросов между фазами
+func (m *memoryPolicyState) quiet() {
+	if (argv.gcRSSWatermarkMB <= 0) || m.quietGCDone {
+		return
+	}
+
+	rss := getRSSMemory()
+	if rss <= argv.gcRSSWatermarkMB*1024*1024 {
+		return
+	}
+
+	m.quietGCDone = true
+
+	gcElapsed := memoryForceGC()
+
+	log.Printf("RSS %dMB above watermark. GC elapsed (ms): %d RSS after: %dMB\n",
+		rss/1024/1024,
+		int64(gcElapsed/time.Millisecond),
+		getRSSMemory()/1024/1024,
+	)
+}
+
+func (m *memoryPolicyState) phaseEnded(phase int) {
+	if (argv.gcPhaseFrom <= 0) || (phase < argv.gcPhaseFrom) {
+		return
+	}
+
+	gcElapsed := memoryForceGC()
+	m.quietGCDone = true
+
+	log.Printf("Phase %d GC. Goroutines: %d GC elapsed (ms): %d RSS: %dMB GC pauses (ms): %s\n",
+		phase,
+		runtime.NumGoroutine(),
+		int64(gcElapsed/time.Millisecond),
+		getRSSMemory()/1024/1024,
+		getGCStats(),
+	)
+}
+
+func memoryForceGC() time.Duration {
+	gcFrom := time.Now()
+	if argv.gcMode == memoryGCOff {
+		runtime.GC()
+	} else {
+		// при живом GC есть смысл сразу вернуть освободившееся системе. FreeOSMemory сам запускает GC
+		debug.FreeOSMemory()
+	}
+	return time.Since(gcFrom)
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+/*
+GET /metrics в текстовом формате Prometheus.
+
+Счетчики пишутся из epoll горутин атомиками в заранее выделенные массивы,
+так что на каждый запрос не приходится ни одной аллокации.
+*/
+
+type (
+	metricsRoute int
+)
+
+const (
+	metricsRouteOther = metricsRoute(iota)
+	metricsRouteUsersGet
+	metricsRouteUsersVisits
+	metricsRouteUsersNew
+	metricsRouteUsersUpdate
+	metricsRouteLocationsGet
+	metricsRouteLocationsAvg
+	metricsRouteLocationsNew
+	metricsRouteLocationsUpdate
+	metricsRouteVisitsGet
+	metricsRouteVisitsNew
+	metricsRouteVisitsUpdate
+	metricsRouteTx
+	metricsRouteAdmin
+	metricsRouteMetrics
+	metricsRouteProbes // /healthz, /readyz, /version
+	metricsRouteDebug  // /debug/...
+	metricsRoutesCount
+)
+
+const (
+	metricsMaxStatus = 600
+)
+
+var (
+	metricsRouteNames = [metricsRoutesCount]string{
+		metricsRouteOther:           `other`,
+		metricsRouteUsersGet:        `users_get`,
+		metricsRouteUsersVisits:     `users_visits`,
+		metricsRouteUsersNew:        `users_new`,
+		metricsRouteUsersUpdate:     `users_update`,
+		metricsRouteLocationsGet:    `locations_get`,
+		metricsRouteLocationsAvg:    `locations_avg`,
+		metricsRouteLocationsNew:    `locations_new`,
+		metricsRouteLocationsUpdate: `locations_update`,
+		metricsRouteVisitsGet:       `visits_get`,
+		metricsRouteVisitsNew:       `visits_new`,
+		metricsRouteVisitsUpdate:    `visits_update`,
+		metricsRouteTx:              `tx`,
+		metricsRouteAdmin:           `admin`,
+		metricsRouteMetrics:         `metrics`,
+		metricsRouteProbes:          `probes`,
+		metricsRouteDebug:           `debug`,
+	}
+
+	// верхние границы корзин гистограммы времени обработки
+	metricsLatencyBuckets = [...]time.Duration{
+		50 * time.Microsecond,
+		100 * time.Microsecond,
+		250 * time.Microsecond,
+		500 * time.Microsecond,
+		1 * time.Millisecond,
+		2500 * time.Microsecond,
+		5 * time.Millisecond,
+		10 * time.Millisecond,
+		25 * time.Millisecond,
+		50 * time.Millisecond,
+		100 * time.Millisecond,
+		250 * time.Millisecond,
+		500 * time.Millisecond,
+		1 * time.Second,
+	}
+
+	metricsRoutes [metricsRoutesCount]metricsRouteStats
+)
+
+type (
+	metricsRouteStats struct {
+		requests   [metricsMaxStatus]int64               // по http статусу
+		latency    [len(metricsLatencyBuckets) + 1]int64 // последняя - +Inf
+		latencySum int64                                 // ns
+	}
+)
+
+func metricsObserve(route metricsRoute, status int, elapsed time.Duration) {
+	if (status < 0) || (status >= metricsMaxStatus) {
+		status = 500
+	}
+
+	stats := &metricsRoutes[route]
+	atomic.AddInt64(&stats.requests[status], 1)
+	atomic.AddInt64(&stats.latencySum, int64(elapsed))
+
+	bucket := 0
+	for bucket < len(metricsLatencyBuckets) && elapsed > metricsLatencyBuckets[bucket] {
+		bucket++
+	}
+	atomic.AddInt64(&stats.latency[bucket], 1)
+}
+
+func reqMetrics(ctx *RequestCtx, req *RequestParams) {
+	// GET /metrics для Prometheus
+
+	buf := ctx.UserBuf[:0]
+
+	buf = append(buf, "# HELP hlc_http_requests_total Processed requests by route and status.\n"...)
+	buf = append(buf, "# TYPE hlc_http_requests_total counter\n"...)
+	for route := range metricsRoutes {
+		stats := &metricsRoutes[route]
+		for status := range stats.requests {
+			if cnt := atomic.LoadInt64(&stats.requests[status]); cnt > 0 {
+				buf = append(buf, `hlc_http_requests_total{route="`...)
+				buf = append(buf, metricsRouteNames[route]...)
+				buf = append(buf, `",code="`...)
+				buf = strconv.AppendInt(buf, int64(status), 10)
+				buf = append(buf, `"} `...)
+				buf = strconv.AppendInt(buf, cnt, 10)
+				buf = append(buf, '\n')
+			}
+		}
+	}
+
+	buf = append(buf, "# HELP hlc_http_request_duration_seconds Request handling time by route.\n"...)
+	buf = append(buf, "# TYPE hlc_http_request_duration_seconds histogram\n"...)
+	for route := range metricsRoutes {
+		stats := &metricsRoutes[route]
+
+		var total int64
+		for bucket := range stats.latency {
+			total += atomic.LoadInt64(&stats.latency[bucket])
+		}
+		if total == 0 {
+			continue
+		}
+
+		var cumulative int64
+		for bucket := range stats.latency {
+			cumulative += atomic.LoadInt64(&stats.latency[bucket])
+
+			buf = append(buf, `hlc_http_request_duration_seconds_bucket{route="`...)
+			buf = append(buf, metricsRouteNames[route]...)
+			buf = append(buf, `",le="`...)
+			if bucket < len(metricsLatencyBuckets) {
+				buf = strconv.AppendFloat(buf, metricsLatencyBuckets[bucket].Seconds(), 'g', -1, 64)
+			} else {
+				buf = append(buf, `+Inf`...)
+			}
+			buf = append(buf, `"} `...)
+			buf = strconv.AppendInt(buf, cumulative, 10)
+			buf = append(buf, '\n')
+		}
+
+		buf = metricsAppendRouteValue(buf, `hlc_http_request_duration_seconds_sum`, route,
+			time.Duration(atomic.LoadInt64(&stats.latencySum)).Seconds())
+		buf = metricsAppendRouteValue(buf, `hlc_http_request_duration_seconds_count`, route, float64(cumulative))
+	}
+
+	buf = append(buf, "# HELP hlc_entities Entities in the indexes.\n"...)
+	buf = append(buf, "# TYPE hlc_entities gauge\n"...)
+	buf = metricsAppendValue(buf, `hlc_entities{type="users"}`, float64(indexUser.Count()))
+	buf = metricsAppendValue(buf, `hlc_entities{type="locations"}`, float64(indexLocation.Count()))
+	buf = metricsAppendValue(buf, `hlc_entities{type="visits"}`, float64(indexVisit.Count()))
+
+	buf = metricsAppendConnections(buf)
+
+	if httpServer.AccessLog != nil {
+		buf = append(buf, "# HELP hlc_access_log_dropped_total Access log entries dropped because the writer fell behind.\n"...)
+		buf = append(buf, "# TYPE hlc_access_log_dropped_total counter\n"...)
+		buf = metricsAppendValue(buf, `hlc_access_log_dropped_total`, float64(httpServer.AccessLog.Dropped()))
+	}
+
+	buf = append(buf, "# HELP process_resident_memory_bytes Resident memory size in bytes.\n"...)
+	buf = append(buf, "# TYPE process_resident_memory_bytes gauge\n"...)
+	buf = metricsAppendValue(buf, `process_resident_memory_bytes`, float64(getRSSMemory()))
+
+	var gcStats debug.GCStats
+	debug.ReadGCStats(&gcStats)
+
+	var lastPause time.Duration
+	if len(gcStats.Pause) > 0 {
+		lastPause = gcStats.Pause[0]
+	}
+
+	buf = append(buf, "# HELP go_gc_cycles_total Completed GC cycles.\n"...)
+	buf = append(buf, "# TYPE go_gc_cycles_total counter\n"...)
+	buf = metricsAppendValue(buf, `go_gc_cycles_total`, float64(gcStats.NumGC))
+	buf = append(buf, "# HELP go_gc_pause_seconds_total Total GC stop-the-world pause time.\n"...)
+	buf = append(buf, "# TYPE go_gc_pause_seconds_total counter\n"...)
+	buf = metricsAppendValue(buf, `go_gc_pause_seconds_total`, gcStats.PauseTotal.Seconds())
+	buf = append(buf, "# HELP go_gc_last_pause_seconds Duration of the last GC pause.\n"...)
+	buf = append(buf, "# TYPE go_gc_last_pause_seconds gauge\n"...)
+	buf = metricsAppendValue(buf, `go_gc_last_pause_seconds`, lastPause.Seconds())
+
+	buf = append(buf, "# HELP go_goroutines Number of goroutines.\n"...)
+	buf = append(buf, "# TYPE go_goroutines gauge\n"...)
+	buf = metricsAppendValue(buf, `go_goroutines`, float64(runtime.NumGoroutine()))
+
+	ctx.SetContentType(contentTypePrometheus)
+	ctx.ResponseBody = buf
+}
+
+func metricsAppendConnections(buf []byte) []byte {
+	_, perListener := httpServer.Stats()
+
+	buf = append(buf, "# HELP hlc_http_connections Currently open client connections.\n"...)
+	buf = append(buf, "# TYPE hlc_http_connections gauge\n"...)
+	buf = metricsAppendValue(buf, `hlc_http_connections`, float64(httpServer.GetCurrentConnections()))
+
+	buf = append(buf, "# HELP hlc_http_listener_connections Currently open client connections by listener.\n"...)
+	buf = append(buf, "# TYPE hlc_http_listener_connections gauge\n"...)
+	for i := range perListener {
+		buf = metricsAppendListenerValue(buf, `hlc_http_listener_connections`, i, ``, float64(perListener[i].Current))
+	}
+
+	buf = append(buf, "# HELP hlc_http_connections_accepted_total Accepted connections by listener.\n"...)
+	buf = append(buf, "# TYPE hlc_http_connections_accepted_total counter\n"...)
+	for i := range perListener {
+		buf = metricsAppendListenerValue(buf, `hlc_http_connections_accepted_total`, i, ``, float64(perListener[i].Accepted))
+	}
+
+	buf = append(buf, "# HELP hlc_http_connections_rejected_total Connections refused because of the max connections limit.\n"...)
+	buf = append(buf, "# TYPE hlc_http_connections_rejected_total counter\n"...)
+	for i := range perListener {
+		buf = metricsAppendListenerValue(buf, `hlc_http_connections_rejected_total`, i, ``, float64(perListener[i].Rejected))
+	}
+
+	buf = append(buf, "# HELP hlc_http_connections_closed_total Closed connections by listener and reason.\n"...)
+	buf = append(buf, "# TYPE hlc_http_connections_closed_total counter\n"...)
+	for i := range perListener {
+		for reason, cnt := range perListener[i].ClosedBy {
+			buf = metricsAppendListenerValue(buf, `hlc_http_connections_closed_total`, i, ConnCloseReasonNames[reason], float64(cnt))
+		}
+	}
+
+	return buf
+}
+
+func metricsAppendListenerValue(buf []byte, name string, listener int, reason string, value float64) []byte {
+	buf = append(buf, name...)
+	buf = append(buf, `{listener="`...)
+	buf = strconv.AppendInt(buf, int64(listener), 10)
+	if reason != `` {
+		buf = append(buf, `",reason="`...)
+		buf = append(buf, reason...)
+	}
+	buf = append(buf, `"} `...)
+	buf = strconv.AppendFloat(buf, value, 'g', -1, 64)
+	buf = append(buf, '\n')
+	return buf
+}
+
+func metricsAppendValue(buf []byte, name string, value float64) []byte {
+	buf = append(buf, name...)
+	buf = append(buf, ' ')
+	buf = strconv.AppendFloat(buf, value, 'g', -1, 64)
+	buf = append(buf, '\n')
+	return buf
+}
+
+func metricsAppendRouteValue(buf []byte, name string, route int, value float64) []byte {
+	buf = append(buf, name...)
+	buf = append(buf, `{route="`...)
+	buf = append(buf, metricsRouteNames[route]...)
+	buf = append(buf, `"} `...)
+	buf = strconv.AppendFloat(buf, value, 'g', -1, 64)
+	buf = append(buf, '\n')
+	return buf
+}
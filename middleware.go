@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"log"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+/*
+Middleware оборачивает RequestHandler и может что-то сделать до и после него
+или ответить сам, не вызывая next. Все замыкания создаются один раз при сборке цепочки,
+на запрос не аллоцируется ничего.
+
+	httpServer.Handler = Chain(requestHandler, MetricsMiddleware, RecoveryMiddleware, ...)
+
+Первый в списке - самый внешний.
+*/
+
+type (
+	Middleware func(next RequestHandler) RequestHandler
+)
+
+func Chain(handler RequestHandler, middlewares ...Middleware) RequestHandler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+// счетчики и гистограммы /metrics по ctx.Route
+func MetricsMiddleware(next RequestHandler) RequestHandler {
+	return func(ctx *RequestCtx) {
+		started := time.Now()
+		next(ctx)
+		metricsObserve(metricsRoute(ctx.Route), ctx.ResponseStatus, time.Since(started))
+	}
+}
+
+// паника в обработчике превращается в 500 с закрытием соединения, процесс продолжает работать.
+// блокировки обработчики должны снимать через defer, иначе после паники они останутся захваченными
+func RecoveryMiddleware(next RequestHandler) RequestHandler {
+	return func(ctx *RequestCtx) {
+		defer func() {
+			if err := recover(); err != nil {
+				log.Printf("Panic on %s %s: %v\n%s", methodNames[ctx.Method], ctx.Path, err, debug.Stack())
+				ctx.Error(500)
+				// состояние ctx могло остаться каким угодно, соединение лучше не переиспользовать
+				ctx.SetConnectionClose()
+			}
+		}()
+
+		next(ctx)
+	}
+}
+
+// 5xx ответы в лог
+func ErrorLogMiddleware(next RequestHandler) RequestHandler {
+	return func(ctx *RequestCtx) {
+		next(ctx)
+		if ctx.ResponseStatus >= 500 {
+			log.Printf("%s %s: %d\n", methodNames[ctx.Method], ctx.Path, ctx.ResponseStatus)
+		}
+	}
+}
+
+// X-Request-Id из запроса возвращается в ответе. выставляется и до обработчика (для потоковых ответов),
+// и после, т.к. ctx.Error сбрасывает заголовки
+func RequestIdMiddleware(next RequestHandler) RequestHandler {
+	return func(ctx *RequestCtx) {
+		id := ctx.RequestHeaders.Peek(strXRequestId)
+		if len(id) > 0 {
+			ctx.ResponseHeaders.Set(strXRequestId, id)
+		}
+
+		next(ctx)
+
+		if (len(id) > 0) && !ctx.ResponseHeaders.Has(strXRequestId) {
+			ctx.ResponseHeaders.Set(strXRequestId, id)
+		}
+	}
+}
+
+// запросы к путям с одним из префиксов требуют "Authorization: Bearer <token>"
+func AuthMiddleware(token []byte, prefixes ...[]byte) Middleware {
+	expected := append(append([]byte{}, strBearerPrefix...), token...)
+
+	return func(next RequestHandler) RequestHandler {
+		return func(ctx *RequestCtx) {
+			if middlewareHasPrefix(ctx.Path, prefixes) &&
+				(subtle.ConstantTimeCompare(ctx.RequestHeaders.Peek(strAuthorization), expected) != 1) {
+				ctx.Error(401)
+				ctx.ResponseHeaders.Add(strWWWAuthenticate, strBearer)
+				return
+			}
+
+			next(ctx)
+		}
+	}
+}
+
+// общий на сервер token bucket: rps запросов в секунду с запасом burst.
+// сверх лимита - 429 с Retry-After. пути с префиксами из exempt не ограничиваются
+func RateLimitMiddleware(rps float64, burst int, exempt ...[]byte) Middleware {
+	limiter := &rateLimiter{
+		rate:   rps,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+
+	return func(next RequestHandler) RequestHandler {
+		return func(ctx *RequestCtx) {
+			if !middlewareHasPrefix(ctx.Path, exempt) && !limiter.Allow() {
+				ctx.Error(429)
+				ctx.ResponseHeaders.Add(strRetryAfter, strOne)
+				return
+			}
+
+			next(ctx)
+		}
+	}
+}
+
+type (
+	rateLimiter struct {
+		mu     sync.Mutex
+		rate   float64
+		burst  float64
+		tokens float64
+		last   time.Time
+	}
+)
+
+func (l *rateLimiter) Allow() bool {
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+func middlewareHasPrefix(path []byte, prefixes [][]byte) bool {
+	for _, prefix := range prefixes {
+		if bytes.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
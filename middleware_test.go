@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// паника в обработчике: 500 с Connection: close, запись в логе от ErrorLogMiddleware, соединение закрыто
+func TestServerMiddlewaresPanic(t *testing.T) {
+	var logged bytes.Buffer
+	saved := log.Writer()
+	log.SetOutput(&logged)
+	defer log.SetOutput(saved)
+
+	s := &HTTPServer{Handler: Chain(func(ctx *RequestCtx) {
+		panic(`boom`)
+	}, serverMiddlewares(false)...)}
+	lp, ctx, client, read := serveTestConn(t, s)
+
+	syscall.Write(client, []byte("GET /users/1 HTTP/1.1\r\nX-Request-Id: abc\r\n\r\n"))
+	lp.serve(ctx)
+
+	response := read()
+	if !strings.HasPrefix(response, "HTTP/1.1 500 ") {
+		t.Fatalf(`response %q, want 500`, response)
+	}
+	for _, header := range []string{"\r\nConnection: close\r\n", "\r\nX-Request-Id: abc\r\n"} {
+		if !strings.Contains(response, header) {
+			t.Errorf(`no %q in %q`, header, response)
+		}
+	}
+	if rest := read(); rest != `` {
+		t.Errorf(`connection still open, got %q`, rest)
+	}
+
+	if !strings.Contains(logged.String(), `Panic on GET /users/1: boom`) {
+		t.Errorf(`panic not logged: %q`, logged.String())
+	}
+	if !strings.Contains(logged.String(), "GET /users/1: 500\n") {
+		t.Errorf(`500 not logged by ErrorLogMiddleware: %q`, logged.String())
+	}
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+Детектор фаз нагрузки.
+
+Фаза начинается с первой секунды, в которую пришел хоть один запрос, и заканчивается,
+когда запросов не было IdleTimeout. Подписчики получают события начала и конца фазы,
+а между фазами - событие простоя на каждом тике. Зовутся синхронно из горутины детектора,
+так что долгую работу подписчик должен уносить в свою горутину сам.
+
+Состав запросов и времена ответа берутся из счетчиков metrics.go как разница на начало и конец фазы.
+Служебные маршруты (пробы, /metrics, /admin, /debug) нагрузкой не считаются: регулярный сбор
+метрик не должен начинать фазы, а с ними и сборку мусора со снимком базы после них.
+*/
+
+type (
+	PhaseEventKind int
+)
+
+const (
+	PhaseStart = PhaseEventKind(iota)
+	PhaseEnd
+	PhaseIdle // тик без запросов вне фазы
+)
+
+type (
+	PhaseLatency struct {
+		// секунды. квантили - верхние границы корзин гистограммы metricsLatencyBuckets
+		Avg float64 `json:"avg"`
+		P50 float64 `json:"p50"`
+		P90 float64 `json:"p90"`
+		P99 float64 `json:"p99"`
+	}
+
+	PhaseEvent struct {
+		Kind     PhaseEventKind   `json:"-"`
+		Phase    int              `json:"phase"`
+		Started  time.Time        `json:"started"`
+		Duration float64          `json:"duration"` // секунды
+		Requests int64            `json:"requests"`
+		QPS      float64          `json:"qps"`
+		PeakQPS  int64            `json:"peak_qps"`
+		Mix      map[string]int64 `json:"mix,omitempty"` // число запросов по маршрутам metricsRouteNames
+		Latency  PhaseLatency     `json:"latency"`
+	}
+
+	PhaseSubscriber func(ev *PhaseEvent)
+
+	PhaseDetector struct {
+		Interval    time.Duration
+		IdleTimeout time.Duration // сколько нужно простоять без запросов, чтобы фаза закончилась
+
+		requests int64 // с прошлого тика
+
+		mu          sync.Mutex
+		subscribers []PhaseSubscriber
+		active      bool
+		idleFor     time.Duration
+		current     PhaseEvent // текущая фаза, если active
+		last        PhaseEvent // последняя закончившаяся, Phase == 0 - еще не было
+		lastBusy    time.Time
+		snapshot    phaseMetricsSnapshot // счетчики на начало текущей фазы
+	}
+
+	phaseSnapshotState struct {
+		mu      sync.Mutex
+		running bool // горутина снимка работает
+		again   bool // пока она писала, закончилась еще фаза
+		phase   int  // последняя закончившаяся фаза, для лога
+	}
+
+	phaseMetricsSnapshot struct {
+		requests   [metricsRoutesCount]int64
+		latency    [len(metricsLatencyBuckets) + 1]int64
+		latencySum int64
+	}
+)
+
+var (
+	phaseDetector = PhaseDetector{
+		Interval:    time.Second,
+		IdleTimeout: time.Second,
+	}
+
+	phaseSnapshot phaseSnapshotState
+)
+
+// вызывается на каждый запрос
+func (d *PhaseDetector) Observe(route metricsRoute) {
+	if !phaseServiceRoute(route) {
+		atomic.AddInt64(&d.requests, 1)
+	}
+}
+
+func phaseServiceRoute(route metricsRoute) bool {
+	switch route {
+	case metricsRouteProbes, metricsRouteMetrics, metricsRouteAdmin, metricsRouteDebug:
+		return true
+	}
+	return false
+}
+
+func (d *PhaseDetector) Subscribe(fn PhaseSubscriber) {
+	d.mu.Lock()
+	d.subscribers = append(d.subscribers, fn)
+	d.mu.Unlock()
+}
+
+func (d *PhaseDetector) Run() {
+	var snapshot phaseMetricsSnapshot
+	snapshot.Read()
+
+	d.mu.Lock()
+	d.snapshot = snapshot
+	d.mu.Unlock()
+
+	for range time.Tick(d.Interval) {
+		d.tick(time.Now())
+	}
+}
+
+func (d *PhaseDetector) tick(now time.Time) {
+	qps := atomic.SwapInt64(&d.requests, 0)
+
+	var snapshot phaseMetricsSnapshot
+	snapshot.Read()
+
+	var ev PhaseEvent
+	notify := true
+
+	d.mu.Lock()
+
+	if qps > 0 {
+		d.idleFor = 0
+		d.lastBusy = now
+
+		if !d.active {
+			d.active = true
+			d.current = PhaseEvent{
+				Kind:    PhaseStart,
+				Phase:   d.last.Phase + 1,
+				Started: now.Add(-d.Interval),
+			}
+			ev = d.current
+		} else {
+			// фаза продолжается
+			notify = false
+		}
+
+		d.current.Requests += qps
+		if qps > d.current.PeakQPS {
+			d.current.PeakQPS = qps
+		}
+	} else if d.active {
+		d.idleFor += d.Interval
+		if d.idleFor < d.IdleTimeout {
+			notify = false
+		} else {
+			d.active = false
+			d.finish(&snapshot)
+			d.last = d.current
+			ev = d.current
+			d.snapshot = snapshot
+		}
+	} else {
+		ev.Kind = PhaseIdle
+		d.snapshot = snapshot
+	}
+
+	subscribers := d.subscribers
+	d.mu.Unlock()
+
+	if !notify {
+		return
+	}
+
+	for _, fn := range subscribers {
+		fn(&ev)
+	}
+}
+
+// итоги текущей фазы. под d.mu
+func (d *PhaseDetector) finish(snapshot *phaseMetricsSnapshot) {
+	ev := &d.current
+	ev.Kind = PhaseEnd
+
+	if duration := d.lastBusy.Sub(ev.Started); duration > 0 {
+		ev.Duration = duration.Seconds()
+		ev.QPS = float64(ev.Requests) / ev.Duration
+	}
+
+	ev.Mix = make(map[string]int64)
+	for route := range snapshot.requests {
+		if phaseServiceRoute(metricsRoute(route)) {
+			continue
+		}
+		if cnt := snapshot.requests[route] - d.snapshot.requests[route]; cnt > 0 {
+			ev.Mix[metricsRouteNames[route]] = cnt
+		}
+	}
+
+	var latency [len(metricsLatencyBuckets) + 1]int64
+	var total int64
+	for bucket := range latency {
+		latency[bucket] = snapshot.latency[bucket] - d.snapshot.latency[bucket]
+		total += latency[bucket]
+	}
+	if total == 0 {
+		return
+	}
+
+	ev.Latency.Avg = time.Duration((snapshot.latencySum - d.snapshot.latencySum) / total).Seconds()
+	ev.Latency.P50 = phaseQuantile(&latency, total, 0.5)
+	ev.Latency.P90 = phaseQuantile(&latency, total, 0.9)
+	ev.Latency.P99 = phaseQuantile(&latency, total, 0.99)
+}
+
+func phaseQuantile(latency *[len(metricsLatencyBuckets) + 1]int64, total int64, q float64) float64 {
+	need := int64(float64(total)*q + 0.5)
+
+	var cumulative int64
+	for bucket, cnt := range latency {
+		cumulative += cnt
+		if (cumulative >= need) && (bucket < len(metricsLatencyBuckets)) {
+			return metricsLatencyBuckets[bucket].Seconds()
+		}
+	}
+
+	// дальше последней границы, точнее не сказать
+	return metricsLatencyBuckets[len(metricsLatencyBuckets)-1].Seconds()
+}
+
+func (s *phaseMetricsSnapshot) Read() {
+	for route := range metricsRoutes {
+		stats := &metricsRoutes[route]
+
+		var requests int64
+		for status := range stats.requests {
+			requests += atomic.LoadInt64(&stats.requests[status])
+		}
+		s.requests[route] = requests
+
+		if phaseServiceRoute(metricsRoute(route)) {
+			continue
+		}
+		for bucket := range stats.latency {
+			s.latency[bucket] += atomic.LoadInt64(&stats.latency[bucket])
+		}
+		s.latencySum += atomic.LoadInt64(&stats.latencySum)
+	}
+}
+
+// текущая фаза (если идет) и последняя закончившаяся
+func (d *PhaseDetector) Status() (current *PhaseEvent, last *PhaseEvent) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.active {
+		ev := d.current
+		ev.Duration = d.lastBusy.Sub(ev.Started).Seconds()
+		if ev.Duration > 0 {
+			ev.QPS = float64(ev.Requests) / ev.Duration
+		}
+		current = &ev
+	}
+	if d.last.Phase > 0 {
+		ev := d.last
+		last = &ev
+	}
+
+	return
+}
+
+func reqAdminPhase(ctx *RequestCtx, req *RequestParams) {
+	// GET /admin/phase
+	current, last := phaseDetector.Status()
+
+	resp := struct {
+		Current *PhaseEvent `json:"current"`
+		Last    *PhaseEvent `json:"last"`
+	}{current, last}
+
+	json.NewEncoder(ctx).Encode(&resp)
+}
+
+// подписчик, пишущий фазы в лог
+func phaseLogSubscriber(ev *PhaseEvent) {
+	switch ev.Kind {
+	case PhaseStart:
+		log.Println(`Phase`, ev.Phase, `started`)
+
+	case PhaseEnd:
+		routes := make([]string, 0, len(ev.Mix))
+		for route := range ev.Mix {
+			routes = append(routes, route)
+		}
+		sort.Strings(routes)
+
+		mix := make([]byte, 0, 256)
+		for _, route := range routes {
+			mix = append(mix, route...)
+			mix = append(mix, '=')
+			mix = strconv.AppendInt(mix, ev.Mix[route], 10)
+			mix = append(mix, ' ')
+		}
+		if len(mix) > 0 {
+			mix = mix[:len(mix)-1] // убираю последний пробел
+		}
+
+		log.Printf("Phase %d ended. Requests: %d QPS avg/peak: %.0f/%d Latency avg/p50/p99 (ms): %.3f/%.3f/%.3f RSS: %dMB Mix: %s\n",
+			ev.Phase, ev.Requests, ev.QPS, ev.PeakQPS,
+			ev.Latency.Avg*1000, ev.Latency.P50*1000, ev.Latency.P99*1000,
+			getRSSMemory()/1024/1024,
+			mix,
+		)
+	}
+}
+
+// подписчик, сбрасывающий базу в -snapshot после каждой фазы. снимок пишется в своей горутине,
+// чтобы не задерживать тики детектора, и не больше одного за раз: фазы, закончившиеся во время
+// записи, дают еще один снимок после нее
+func phaseSnapshotSubscriber(ev *PhaseEvent) {
+	if ev.Kind != PhaseEnd {
+		return
+	}
+
+	s := &phaseSnapshot
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.phase = ev.Phase
+	if s.running {
+		s.again = true
+		return
+	}
+	s.running = true
+
+	go s.run()
+}
+
+func (s *phaseSnapshotState) run() {
+	for {
+		s.mu.Lock()
+		phase := s.phase
+		s.mu.Unlock()
+
+		started := time.Now()
+		snapshotLock.Lock()
+		// следующая фаза может начаться, пока архив пишется: писателей на это время держать нельзя
+		err := exportDBCopyToFile(argv.snapshotPath)
+		snapshotLock.Unlock()
+
+		if err != nil {
+			log.Println(`snapshot DB fail:`, err)
+		} else {
+			log.Printf("DB dumped into %s after phase %d in %s\n", argv.snapshotPath, phase, time.Since(started))
+		}
+
+		s.mu.Lock()
+		if !s.again {
+			s.running = false
+			s.mu.Unlock()
+			return
+		}
+		s.again = false
+		s.mu.Unlock()
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// сбор метрик, пробы и админка не открывают фазу и не попадают в Mix
+func TestPhaseServiceRoutes(t *testing.T) {
+	d := PhaseDetector{Interval: time.Second, IdleTimeout: time.Second}
+
+	var (
+		events []PhaseEventKind
+		mix    map[string]int64
+	)
+	d.Subscribe(func(ev *PhaseEvent) {
+		events = append(events, ev.Kind)
+		if ev.Kind == PhaseEnd {
+			mix = ev.Mix
+		}
+	})
+
+	request := func(route metricsRoute) {
+		atomic.AddInt64(&metricsRoutes[route].requests[200], 1)
+		d.Observe(route)
+	}
+	scrape := func() {
+		for _, route := range []metricsRoute{metricsRouteMetrics, metricsRouteProbes, metricsRouteAdmin, metricsRouteDebug} {
+			request(route)
+		}
+	}
+
+	now := time.Now()
+	tick := func() {
+		now = now.Add(d.Interval)
+		d.tick(now)
+	}
+
+	for i := 0; i < 3; i++ {
+		scrape()
+		tick()
+	}
+	if want := []PhaseEventKind{PhaseIdle, PhaseIdle, PhaseIdle}; !reflect.DeepEqual(events, want) {
+		t.Fatalf(`events on scrapes only: %v, want %v`, events, want)
+	}
+
+	events = nil
+	request(metricsRouteUsersGet)
+	scrape()
+	tick()
+	scrape()
+	tick()
+
+	if want := []PhaseEventKind{PhaseStart, PhaseEnd}; !reflect.DeepEqual(events, want) {
+		t.Fatalf(`events: %v, want %v`, events, want)
+	}
+	if want := map[string]int64{`users_get`: 1}; !reflect.DeepEqual(mix, want) {
+		t.Errorf(`mix %v, want %v`, mix, want)
+	}
+}
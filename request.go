@@ -7,11 +7,11 @@ import (
 
 type (
 	RequestParams struct {
-		isGET  bool
-		isNew  bool
-		id     int32
-		entity []byte
-		action []byte
+		id  int32  // параметр {id:int} из пути маршрута
+		uri []byte // путь без аргументов
+
+		params    [routeMaxParams]routeParam // параметры из пути, заполняет Router
+		paramsLen int
 
 		fromDate   int32 // visited_at > fromDate
 		toDate     int32 // visited_at < toDate
@@ -20,6 +20,13 @@ type (
 		fromAge    int32 // учитывать только путешественников, у которых возраст (в годах) (считается от текущего timestamp) больше этого параметра
 		toAge      int32 // как предыдущее, но наоборот
 		gender     byte  // учитывать оценки только мужчин или женщин
+
+		seconds int32 // длительность CPU профиля в /debug/pprof/profile
+		debug   int32 // формат профилей /debug/pprof/*: 0 - бинарный, 1 и 2 - текстовый
+
+		// заполняются обработчиками для журнала медленных запросов
+		scanned int32 // сколько элементов кеша просмотрено
+		matched int32 // сколько из них подошло под фильтры
 	}
 )
 
@@ -98,17 +105,31 @@ func parseArgs(ctx *RequestCtx, args []byte, params *RequestParams) bool {
 				return false
 			}
 			params.gender = val[0]
+		} else if bytes.Equal(arg, strSeconds) {
+			if i64, ok := byteSliceToInt64(val); !ok {
+				return false
+			} else {
+				params.seconds = int32(i64)
+			}
+		} else if bytes.Equal(arg, strDebug) {
+			if i64, ok := byteSliceToInt64(val); !ok {
+				return false
+			} else {
+				params.debug = int32(i64)
+			}
 		}
 	}
 
 	return true
 }
 
+// разбор пути и аргументов. сам маршрут выбирает Router по params.uri
 func parseRequest(ctx *RequestCtx, params *RequestParams) bool {
-	// method
-	params.isGET = ctx.Method == MethodGET
+	if (len(ctx.Path) == 0) || (ctx.Path[0] != '/') {
+		return false
+	}
 
-	uri := ctx.Path[1:] // убираю начальный /
+	uri := ctx.Path
 
 	var args []byte
 
@@ -117,21 +138,10 @@ func parseRequest(ctx *RequestCtx, params *RequestParams) bool {
 		args = uri[idx+1:]
 		uri = uri[:idx]
 	}
+	params.uri = uri
 
-	// entity
-	if idx := bytes.IndexByte(uri, '/'); idx > 0 {
-		params.entity = uri[0:idx]
-		uri = uri[idx+1:]
-	} else if idx == -1 {
-		params.entity = uri
-		uri = nil
-	} else {
-		return false
-	}
-
-	params.isNew = false
-	params.action = nil
 	params.id = 0
+	params.paramsLen = 0
 	params.fromDate = 0
 	params.toDate = 0
 	params.countryIdx = 0
@@ -139,41 +149,8 @@ func parseRequest(ctx *RequestCtx, params *RequestParams) bool {
 	params.fromAge = 0
 	params.toAge = 0
 	params.gender = 0
-
-	if len(uri) == 0 {
-		return true
-	}
-
-	// id
-	if bytes.Equal(uri, strNew) {
-		// /<entity>/new
-		params.isNew = true
-		uri = nil
-	} else if idx := bytes.IndexByte(uri, '/'); idx == 0 {
-		return false
-	} else {
-		// /<entity>/<id>
-		tail := uri
-		to := idx
-		if to == -1 {
-			to = len(uri)
-			tail = nil
-		} else {
-			tail = uri[to+1:]
-		}
-
-		if i64, ok := byteSliceToInt64(uri[0:to]); ok {
-			params.id = int32(i64)
-		} // else  // могут быть всякие "/users/bad". это корректный запрос, просто 404
-
-		uri = tail
-	}
-
-	// action
-	if len(uri) > 0 {
-		// /users/<id>/visits
-		params.action = uri
-	}
+	params.seconds = 0
+	params.debug = 0
 
 	return parseArgs(ctx, args, params)
 }
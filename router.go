@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"math"
+	"strings"
+)
+
+/*
+Маршрутизатор по методу и шаблону пути.
+
+Шаблон - сегменты через '/', каждый либо литерал, либо параметр:
+	/users/{id:int}/visits   {id:int} - целое в пределах int32, иначе маршрут не подходит (404)
+	/debug/pprof/{name}      {name} - любой непустой сегмент
+Значения параметров кладутся в RequestParams без аллокаций, параметр id дублируется в req.id.
+
+Маршруты перебираются по порядку регистрации. Если путь подошел, а метод нет - 405 с заголовком Allow.
+*/
+
+const (
+	routeMaxParams = 4
+)
+
+type (
+	routeParamKind int
+
+	RouteHandler func(ctx *RequestCtx, req *RequestParams)
+
+	Router struct {
+		routes []routeEntry
+	}
+
+	routeEntry struct {
+		method   Method
+		pattern  string
+		segments []routeSegment
+		metrics  metricsRoute
+		handler  RouteHandler
+	}
+
+	routeSegment struct {
+		literal []byte
+		param   routeParamKind
+		name    string
+	}
+
+	routeParam struct {
+		name     string
+		value    []byte
+		intValue int64
+	}
+)
+
+const (
+	routeParamNone = routeParamKind(iota)
+	routeParamString
+	routeParamInt
+)
+
+// регистрация маршрута. кривой шаблон - ошибка в коде, поэтому сразу падаем
+func (r *Router) Handle(method Method, pattern string, metrics metricsRoute, handler RouteHandler) {
+	if !strings.HasPrefix(pattern, `/`) {
+		log.Fatalf(`Router: pattern %q must start with /`, pattern)
+	}
+
+	entry := routeEntry{
+		method:  method,
+		pattern: pattern,
+		metrics: metrics,
+		handler: handler,
+	}
+
+	params := 0
+	for _, part := range strings.Split(pattern[1:], `/`) {
+		var segment routeSegment
+
+		if strings.HasPrefix(part, `{`) && strings.HasSuffix(part, `}`) {
+			segment.name = part[1 : len(part)-1]
+			segment.param = routeParamString
+			if idx := strings.IndexByte(segment.name, ':'); idx != -1 {
+				switch segment.name[idx+1:] {
+				case `int`:
+					segment.param = routeParamInt
+				case `str`:
+				default:
+					log.Fatalf(`Router: unknown param type in %q`, pattern)
+				}
+				segment.name = segment.name[:idx]
+			}
+
+			if params++; params > routeMaxParams {
+				log.Fatalf(`Router: too many params in %q`, pattern)
+			}
+		} else {
+			segment.literal = []byte(part)
+		}
+
+		entry.segments = append(entry.segments, segment)
+	}
+
+	r.routes = append(r.routes, entry)
+}
+
+// выбор маршрута по req.uri и вызов обработчика
+func (r *Router) Dispatch(ctx *RequestCtx, req *RequestParams) {
+	var allowed [MethodsCount]bool
+	pathMatched := false
+
+	for i := range r.routes {
+		entry := &r.routes[i]
+
+		if !entry.match(req.uri, req) {
+			continue
+		} else if !entry.allows(ctx.Method) {
+			allowed[entry.method] = true
+			if entry.method == MethodGET {
+				allowed[MethodHEAD] = true
+			}
+			pathMatched = true
+			continue
+		}
+
+		ctx.Route = int(entry.metrics)
+		req.id = int32(req.ParamInt(`id`))
+		entry.handler(ctx, req)
+		return
+	}
+
+	if !pathMatched {
+		ctx.ResponseStatus = 404
+		return
+	}
+
+	var tmp [64]byte
+	allow := tmp[:0]
+	for method, ok := range allowed {
+		if ok {
+			if len(allow) > 0 {
+				allow = append(allow, ", "...)
+			}
+			allow = append(allow, methodNames[method]...)
+		}
+	}
+
+	ctx.ResponseStatus = 405
+	ctx.ResponseHeaders.Add(strAllow, allow)
+}
+
+// HEAD обслуживается GET маршрутами, тело ответа отбрасывает сервер
+func (entry *routeEntry) allows(method Method) bool {
+	return (entry.method == method) || ((method == MethodHEAD) && (entry.method == MethodGET))
+}
+
+func (entry *routeEntry) match(uri []byte, req *RequestParams) bool {
+	if (len(uri) == 0) || (uri[0] != '/') {
+		return false
+	}
+
+	rest := uri[1:]
+	done := false
+	req.paramsLen = 0
+
+	for i := range entry.segments {
+		segment := &entry.segments[i]
+
+		if done {
+			// путь короче шаблона
+			return false
+		}
+
+		var part []byte
+		if idx := bytes.IndexByte(rest, '/'); idx == -1 {
+			part = rest
+			done = true
+		} else {
+			part = rest[:idx]
+			rest = rest[idx+1:]
+		}
+
+		switch segment.param {
+		case routeParamNone:
+			if !bytes.Equal(part, segment.literal) {
+				return false
+			}
+
+		case routeParamString:
+			if len(part) == 0 {
+				return false
+			}
+			req.params[req.paramsLen] = routeParam{name: segment.name, value: part}
+			req.paramsLen++
+
+		case routeParamInt:
+			i64, ok := routeParseInt(part)
+			if !ok {
+				return false
+			}
+			req.params[req.paramsLen] = routeParam{name: segment.name, value: part, intValue: i64}
+			req.paramsLen++
+		}
+	}
+
+	// путь длиннее шаблона
+	return done
+}
+
+// целое для {name:int}. byteSliceToInt64 при переполнении заворачивается, поэтому длина и диапазон проверяются здесь:
+// иначе /users/4294967297 отдавал бы пользователя 1
+func routeParseInt(part []byte) (int64, bool) {
+	digits := part
+	if (len(digits) > 0) && (digits[0] == '-') {
+		digits = digits[1:]
+	}
+	if (len(digits) == 0) || (len(digits) > 10) {
+		return 0, false
+	}
+
+	i64, ok := byteSliceToInt64(part)
+	if !ok || (i64 > math.MaxInt32) || (i64 < math.MinInt32) {
+		return 0, false
+	}
+	return i64, true
+}
+
+// значение параметра пути, nil - такого нет
+func (req *RequestParams) Param(name string) []byte {
+	for i := 0; i < req.paramsLen; i++ {
+		if req.params[i].name == name {
+			return req.params[i].value
+		}
+	}
+	return nil
+}
+
+// значение целочисленного параметра пути, 0 - такого нет
+func (req *RequestParams) ParamInt(name string) int64 {
+	for i := 0; i < req.paramsLen; i++ {
+		if req.params[i].name == name {
+			return req.params[i].intValue
+		}
+	}
+	return 0
+}
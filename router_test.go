@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestRouterDispatch(t *testing.T) {
+	var r Router
+
+	handler := func(name string) RouteHandler {
+		return func(ctx *RequestCtx, req *RequestParams) {
+			ctx.ResponseBody = []byte(name)
+		}
+	}
+	r.Handle(MethodGET, `/users/{id:int}`, metricsRouteUsersGet, handler(`user`))
+	r.Handle(MethodGET, `/users/{id:int}/visits`, metricsRouteUsersVisits, handler(`visits`))
+	r.Handle(MethodPOST, `/users/new`, metricsRouteUsersNew, handler(`new`))
+	r.Handle(MethodPOST, `/users/{id:int}`, metricsRouteUsersUpdate, handler(`update`))
+	r.Handle(MethodGET, `/debug/pprof/{name}`, metricsRouteDebug, handler(`pprof`))
+
+	tests := []struct {
+		method  Method
+		uri     string
+		status  int
+		handler string
+		id      int32
+		allow   string
+	}{
+		{method: MethodGET, uri: `/users/1`, status: 200, handler: `user`, id: 1},
+		{method: MethodHEAD, uri: `/users/1`, status: 200, handler: `user`, id: 1},
+		{method: MethodPOST, uri: `/users/7`, status: 200, handler: `update`, id: 7},
+		{method: MethodGET, uri: `/users/2147483647`, status: 200, handler: `user`, id: 2147483647},
+		{method: MethodGET, uri: `/users/-3`, status: 200, handler: `user`, id: -3},
+		{method: MethodGET, uri: `/users/2147483648`, status: 404},
+		{method: MethodGET, uri: `/users/4294967297`, status: 404},
+		{method: MethodGET, uri: `/users/18446744073709551617`, status: 404},
+		{method: MethodGET, uri: `/users/-`, status: 404},
+		{method: MethodGET, uri: `/users/`, status: 404},
+		{method: MethodGET, uri: `/users/1x`, status: 404},
+		{method: MethodGET, uri: `/users/1/visits`, status: 200, handler: `visits`, id: 1},
+		{method: MethodGET, uri: `/users/1/visits/2`, status: 404},
+		{method: MethodPOST, uri: `/users/new`, status: 200, handler: `new`},
+		{method: MethodGET, uri: `/users/new`, status: 405, allow: `POST`},
+		{method: MethodPOST, uri: `/users/1/visits`, status: 405, allow: `GET, HEAD`},
+		{method: MethodGET, uri: `/debug/pprof/heap`, status: 200, handler: `pprof`},
+		{method: MethodGET, uri: `/debug/pprof/`, status: 404},
+		{method: MethodGET, uri: `users/1`, status: 404},
+	}
+
+	for _, test := range tests {
+		var (
+			ctx RequestCtx
+			req RequestParams
+		)
+		ctx.resetRequest()
+		ctx.Method = test.method
+		req.uri = []byte(test.uri)
+
+		r.Dispatch(&ctx, &req)
+
+		if ctx.ResponseStatus != test.status {
+			t.Errorf(`%s %s: status %d, want %d`, methodNames[test.method], test.uri, ctx.ResponseStatus, test.status)
+			continue
+		}
+		if string(ctx.ResponseBody) != test.handler {
+			t.Errorf(`%s %s: handler %q, want %q`, methodNames[test.method], test.uri, ctx.ResponseBody, test.handler)
+		}
+		if (test.status == 200) && (req.id != test.id) {
+			t.Errorf(`%s %s: id %d, want %d`, methodNames[test.method], test.uri, req.id, test.id)
+		}
+		if allow := string(ctx.ResponseHeaders.Peek(strAllow)); allow != test.allow {
+			t.Errorf(`%s %s: Allow %q, want %q`, methodNames[test.method], test.uri, allow, test.allow)
+		}
+	}
+}
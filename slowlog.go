@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+/*
+Журнал медленных запросов.
+
+Запросы, обработка которых заняла не меньше -slow-threshold, вместе с разобранными параметрами
+и числом просмотренных/подошедших элементов кеша складываются в кольцевой буфер
+на -slow-log-size записей. Отдается через GET /admin/slow, новые записи первыми.
+*/
+
+type (
+	slowLogEntry struct {
+		Time     time.Time `json:"time"`
+		Route    string    `json:"route"`
+		Path     string    `json:"path"`
+		Status   int       `json:"status"`
+		Elapsed  float64   `json:"elapsed"` // секунды
+		EntityId int32     `json:"id"`
+
+		FromDate   int32  `json:"fromDate,omitempty"`
+		ToDate     int32  `json:"toDate,omitempty"`
+		Country    string `json:"country,omitempty"`
+		ToDistance int32  `json:"toDistance,omitempty"`
+		FromAge    int32  `json:"fromAge,omitempty"`
+		ToAge      int32  `json:"toAge,omitempty"`
+		Gender     string `json:"gender,omitempty"`
+
+		Scanned int32 `json:"scanned"` // сколько элементов кеша просмотрено
+		Matched int32 `json:"matched"` // сколько из них подошло под фильтры
+	}
+
+	slowLogRing struct {
+		mu      sync.Mutex
+		entries []slowLogEntry
+		next    int   // куда писать следующую запись
+		total   int64 // сколько всего записано с запуска
+	}
+)
+
+var (
+	slowLog slowLogRing
+)
+
+func (r *slowLogRing) Init(size int) {
+	r.mu.Lock()
+	r.entries = make([]slowLogEntry, 0, size)
+	r.next = 0
+	r.mu.Unlock()
+}
+
+// вызывается из epoll горутины уже после обработки, только для медленных запросов
+func (r *slowLogRing) Record(ctx *RequestCtx, req *RequestParams, elapsed time.Duration) {
+	entry := slowLogEntry{
+		Time:     time.Now(),
+		Route:    metricsRouteNames[ctx.Route],
+		Path:     string(ctx.Path),
+		Status:   ctx.ResponseStatus,
+		Elapsed:  elapsed.Seconds(),
+		EntityId: req.id,
+
+		FromDate:   req.fromDate,
+		ToDate:     req.toDate,
+		ToDistance: req.toDistance,
+		FromAge:    req.fromAge,
+		ToAge:      req.toAge,
+
+		Scanned: req.scanned,
+		Matched: req.matched,
+	}
+	if req.countryIdx > 0 {
+		entry.Country = string(indexCountry.GetByIdx(req.countryIdx))
+	}
+	if req.gender != 0 {
+		entry.Gender = string(req.gender)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if cap(r.entries) == 0 {
+		return
+	} else if len(r.entries) < cap(r.entries) {
+		r.entries = append(r.entries, entry)
+	} else {
+		r.entries[r.next] = entry
+	}
+	r.next = (r.next + 1) % cap(r.entries)
+	r.total++
+}
+
+// копия записей, новые первыми
+func (r *slowLogRing) Snapshot() (entries []slowLogEntry, total int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entries = make([]slowLogEntry, 0, len(r.entries))
+	for i := 1; i <= len(r.entries); i++ {
+		idx := (r.next - i + len(r.entries)) % len(r.entries)
+		entries = append(entries, r.entries[idx])
+	}
+
+	return entries, r.total
+}
+
+func reqAdminSlow(ctx *RequestCtx, req *RequestParams) {
+	// GET /admin/slow
+	entries, total := slowLog.Snapshot()
+
+	resp := struct {
+		Threshold float64        `json:"threshold"` // секунды
+		Total     int64          `json:"total"`
+		Entries   []slowLogEntry `json:"entries"`
+	}{
+		Threshold: argv.slowThreshold.Seconds(),
+		Total:     total,
+		Entries:   entries,
+	}
+
+	json.NewEncoder(ctx).Encode(&resp)
+}
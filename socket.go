@@ -1,7 +1,9 @@
 package main
 
 import (
-	"net"
+	"encoding/binary"
+	"fmt"
+	"os"
 	"syscall"
 )
 
@@ -11,11 +13,28 @@ const (
 	SO_REUSEPORT   = 15 // нет в stdlib
 )
 
-func socketCreateListener(port int) (serverFd int, err error) {
-	addr := syscall.SockaddrInet4{Port: port}
-	copy(addr.Addr[:], net.ParseIP(`0.0.0.0`).To4())
+func socketCreateListener(addr ListenAddr) (serverFd int, err error) {
+	var (
+		domain int
+		sa     syscall.Sockaddr
+	)
 
-	serverFd, err = syscall.Socket(syscall.AF_INET, syscall.O_NONBLOCK|syscall.SOCK_STREAM, 0)
+	switch addr.Network {
+	case listenNetworkTCP4:
+		sa4 := &syscall.SockaddrInet4{Port: addr.Port}
+		copy(sa4.Addr[:], addr.IP.To4())
+		domain, sa = syscall.AF_INET, sa4
+	case listenNetworkTCP6:
+		sa6 := &syscall.SockaddrInet6{Port: addr.Port}
+		copy(sa6.Addr[:], addr.IP.To16())
+		domain, sa = syscall.AF_INET6, sa6
+	case listenNetworkUnix:
+		domain, sa = syscall.AF_UNIX, &syscall.SockaddrUnix{Name: addr.Path}
+	default:
+		return 0, fmt.Errorf(`unknown network %q`, addr.Network)
+	}
+
+	serverFd, err = syscall.Socket(domain, syscall.O_NONBLOCK|syscall.SOCK_STREAM, 0)
 	if err != nil {
 		return
 	}
@@ -25,20 +44,52 @@ func socketCreateListener(port int) (serverFd int, err error) {
 		return
 	}
 
-	if err = syscall.SetsockoptInt(serverFd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
-		syscall.Close(serverFd)
-		return
+	if domain != syscall.AF_UNIX {
+		if err = syscall.SetsockoptInt(serverFd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+			syscall.Close(serverFd)
+			return
+		}
+
+		if err = syscall.SetsockoptInt(serverFd, syscall.SOL_SOCKET, SO_REUSEPORT, 1); err != nil {
+			syscall.Close(serverFd)
+			return
+		}
 	}
 
-	if err = syscall.SetsockoptInt(serverFd, syscall.SOL_SOCKET, SO_REUSEPORT, 1); err != nil {
-		syscall.Close(serverFd)
-		return
+	if domain == syscall.AF_INET6 {
+		// [::] принимает и IPv4 (dual-stack), конкретный IPv6 адрес - только себя
+		v6only := 1
+		if addr.IP.IsUnspecified() {
+			v6only = 0
+		}
+		if err = syscall.SetsockoptInt(serverFd, syscall.IPPROTO_IPV6, syscall.IPV6_V6ONLY, v6only); err != nil {
+			syscall.Close(serverFd)
+			return
+		}
+	}
+
+	if domain == syscall.AF_UNIX {
+		if err = socketRemoveStaleUnix(addr.Path); err != nil {
+			syscall.Close(serverFd)
+			return
+		}
 	}
 
-	if err = syscall.Bind(serverFd, &addr); err != nil {
+	if err = syscall.Bind(serverFd, sa); err != nil {
 		syscall.Close(serverFd)
 		return
-	} else if err = syscall.Listen(serverFd, syscall.SOMAXCONN); err != nil {
+	}
+
+	if (domain == syscall.AF_UNIX) && (addr.Mode != 0) {
+		// до Listen, чтобы никто не успел подключиться с правами по umask
+		if err = os.Chmod(addr.Path, addr.Mode); err != nil {
+			syscall.Close(serverFd)
+			syscall.Unlink(addr.Path)
+			return
+		}
+	}
+
+	if err = syscall.Listen(serverFd, syscall.SOMAXCONN); err != nil {
 		syscall.Close(serverFd)
 		return
 	}
@@ -46,6 +97,35 @@ func socketCreateListener(port int) (serverFd int, err error) {
 	return
 }
 
+// файл сокета, оставшийся от упавшего процесса, мешает bind. удаляется, только если на нем
+// никто не слушает (ECONNREFUSED): иначе второй экземпляр молча отобрал бы адрес у живого.
+// обычные файлы не трогаем
+func socketRemoveStaleUnix(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	} else if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf(`%s exists and is not a socket`, path)
+	}
+
+	// без блокировки: при заполненной очереди живого сервера connect ждал бы
+	fd, err := syscall.Socket(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	err = syscall.Connect(fd, &syscall.SockaddrUnix{Name: path})
+	syscall.Close(fd)
+
+	if err == nil || err == syscall.EAGAIN {
+		return fmt.Errorf(`%s: %v`, path, syscall.EADDRINUSE)
+	} else if err != syscall.ECONNREFUSED {
+		return fmt.Errorf(`%s: %v`, path, err)
+	}
+	return syscall.Unlink(path)
+}
+
 func socketSetNonBlocking(fd int) error {
 	return syscall.SetNonblock(fd, true)
 }
@@ -65,3 +145,47 @@ func socketCreateListenerEpoll(serverFd int) (epollFd int, err error) {
 
 	return epollFd, nil
 }
+
+// включает/выключает ожидание EPOLLOUT для клиентского соединения
+func socketEpollWatchWrite(epollFd, fd int, enable bool) error {
+	var event syscall.EpollEvent
+	event.Events = syscall.EPOLLIN | EPOLLET
+	if enable {
+		event.Events |= syscall.EPOLLOUT
+	}
+	event.Fd = int32(fd)
+
+	return syscall.EpollCtl(epollFd, syscall.EPOLL_CTL_MOD, fd, &event)
+}
+
+// eventfd, которым другие горутины будят epoll горутину
+func socketCreateEventFd(epollFd int) (eventFd int, err error) {
+	r, _, errno := syscall.RawSyscall(syscall.SYS_EVENTFD2, 0, syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+	if errno != 0 {
+		return 0, errno
+	}
+	eventFd = int(r)
+
+	var event syscall.EpollEvent
+	event.Events = syscall.EPOLLIN | EPOLLET
+	event.Fd = int32(eventFd)
+
+	if err = syscall.EpollCtl(epollFd, syscall.EPOLL_CTL_ADD, eventFd, &event); err != nil {
+		syscall.Close(eventFd)
+		return 0, err
+	}
+
+	return eventFd, nil
+}
+
+func socketEventFdNotify(eventFd int) error {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], 1)
+	_, err := syscall.Write(eventFd, buf[:])
+	return err
+}
+
+func socketEventFdDrain(eventFd int) {
+	var buf [8]byte
+	syscall.Read(eventFd, buf[:])
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"strconv"
+)
+
+/*
+Статусные строки ответа собираются один раз при старте для всех кодов 100-599.
+Для кодов без стандартного текста остается пустая reason-phrase (RFC 7230 3.1.2 это допускает).
+*/
+
+const (
+	statusMin = 100
+	statusMax = 599
+)
+
+var (
+	statusTexts = map[int]string{
+		100: `Continue`,
+		101: `Switching Protocols`,
+		102: `Processing`,
+		103: `Early Hints`,
+
+		200: `OK`,
+		201: `Created`,
+		202: `Accepted`,
+		203: `Non-Authoritative Information`,
+		204: `No Content`,
+		205: `Reset Content`,
+		206: `Partial Content`,
+		207: `Multi-Status`,
+		208: `Already Reported`,
+		226: `IM Used`,
+
+		300: `Multiple Choices`,
+		301: `Moved Permanently`,
+		302: `Found`,
+		303: `See Other`,
+		304: `Not Modified`,
+		305: `Use Proxy`,
+		307: `Temporary Redirect`,
+		308: `Permanent Redirect`,
+
+		400: `Bad Request`,
+		401: `Unauthorized`,
+		402: `Payment Required`,
+		403: `Forbidden`,
+		404: `Not Found`,
+		405: `Method Not Allowed`,
+		406: `Not Acceptable`,
+		407: `Proxy Authentication Required`,
+		408: `Request Timeout`,
+		409: `Conflict`,
+		410: `Gone`,
+		411: `Length Required`,
+		412: `Precondition Failed`,
+		413: `Payload Too Large`,
+		414: `URI Too Long`,
+		415: `Unsupported Media Type`,
+		416: `Range Not Satisfiable`,
+		417: `Expectation Failed`,
+		418: `I'm a teapot`,
+		421: `Misdirected Request`,
+		422: `Unprocessable Entity`,
+		423: `Locked`,
+		424: `Failed Dependency`,
+		425: `Too Early`,
+		426: `Upgrade Required`,
+		428: `Precondition Required`,
+		429: `Too Many Requests`,
+		431: `Request Header Fields Too Large`,
+		451: `Unavailable For Legal Reasons`,
+
+		500: `Internal Server Error`,
+		501: `Not Implemented`,
+		502: `Bad Gateway`,
+		503: `Service Unavailable`,
+		504: `Gateway Timeout`,
+		505: `HTTP Version Not Supported`,
+		506: `Variant Also Negotiates`,
+		507: `Insufficient Storage`,
+		508: `Loop Detected`,
+		510: `Not Extended`,
+		511: `Network Authentication Required`,
+	}
+
+	statusLines [statusMax + 1][]byte
+)
+
+func init() {
+	for status := statusMin; status <= statusMax; status++ {
+		line := append([]byte(`HTTP/1.1 `), strconv.Itoa(status)...)
+		line = append(line, ' ')
+		line = append(line, statusTexts[status]...)
+		line = append(line, "\r\n"...)
+		statusLines[status] = line
+	}
+}
+
+// "HTTP/1.1 404 Not Found\r\n". коды вне 100-599 превращаются в 500
+func statusLine(status int) []byte {
+	if (status < statusMin) || (status > statusMax) {
+		status = 500
+	}
+	return statusLines[status]
+}
+
+// ответы без тела и без Content-Length (RFC 7230 3.3.2, 3.3.3)
+func statusBodiless(status int) bool {
+	return ((status >= 100) && (status < 200)) || (status == 204) || (status == 304)
+}
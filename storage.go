@@ -0,0 +1,95 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// общий счетчик версий сущностей. общий, чтобы после удаления и повторного создания
+	// сущность не получила уже выданный когда-то ETag
+	dbVersion uint64
+	// эпоха запуска, входит в ETag: после перезапуска версии выдаются заново
+	dbEpoch = uint64(time.Now().UnixNano())
+)
+
+func dbNextVersion() uint64 {
+	return atomic.AddUint64(&dbVersion, 1)
+}
+
+// изменения, затрагивающие сразу несколько индексов и кеши.
+// все store* функции вызываются под dbLock.Lock и возвращают http статус
+
+func storeVisitNew(visit *Visit) int {
+	// визит попадает в индекс только вместе с кешами, иначе при 404 он оставался бы в индексе без них
+	if user := indexUser.Get(visit.User); user == nil {
+		return 404
+	} else if location := indexLocation.Get(visit.Location); location == nil {
+		return 404
+	} else if !indexVisit.Add(visit) {
+		return 400
+	} else {
+		user.cache.Add(location, visit)
+		location.cache.Add(location, visit, user)
+	}
+
+	return 200
+}
+
+func storeVisitUpdate(id int32, update *Visit) int {
+	if visit := indexVisit.Get(id); visit == nil {
+		return 404
+	} else if (update.User != 0) && (indexUser.Get(update.User) == nil) {
+		// иначе визит остался бы без кешей у несуществующего пользователя
+		return 404
+	} else if (update.Location != 0) && (indexLocation.Get(update.Location) == nil) {
+		return 404
+	} else {
+		visit.Update(update)
+	}
+
+	return 200
+}
+
+func storeVisitDelete(id int32) int {
+	visit := indexVisit.Get(id)
+	if visit == nil {
+		return 404
+	}
+
+	if user := indexUser.Get(visit.User); user != nil {
+		user.cache.RemoveByVisitId(id)
+	}
+	if location := indexLocation.Get(visit.Location); location != nil {
+		location.cache.RemoveByVisitId(id)
+	}
+
+	indexVisit.Delete(id)
+
+	return 200
+}
+
+func storeUserDelete(id int32) int {
+	if user := indexUser.Get(id); user == nil {
+		return 404
+	} else if len(user.cache.visits) > 0 {
+		// сначала нужно удалить или перенести визиты пользователя
+		return 409
+	}
+
+	indexUser.Delete(id)
+
+	return 200
+}
+
+func storeLocationDelete(id int32) int {
+	if location := indexLocation.Get(id); location == nil {
+		return 404
+	} else if len(location.cache.locations) > 0 {
+		return 409
+	}
+
+	indexLocation.Delete(id)
+
+	return 200
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"syscall"
+)
+
+/*
+Потоковая отдача тела ответа, когда его неудобно или дорого собирать целиком.
+
+	ctx.StartStream()     // заголовки (без Content-Length) уходят сразу
+	ctx.Write(part)       // каждый Write - отдельный chunk
+	...                   // по завершении обработчика сервер допишет последний chunk сам
+
+Куски копятся в outputBuf и, как только их набирается streamFlushSize, пишутся в сокет
+без блокировки. Что не влезло в сокет, остается в outputBuf и дописывается как обычно
+по EPOLLOUT после выхода из обработчика. Мелкие Write лучше склеивать в UserBuf самому:
+каждый кусок стоит лишних ~10 байт.
+
+HTTP/1.0 клиенты получают тело без chunked, конец ответа - закрытие соединения.
+
+Обработчик пишет прямо в сокет, поэтому медленный клиент не тормозит его, а копит ответ
+в памяти. Для больших ответов (выгрузка базы) есть StreamAsync: тело пишет отдельная горутина
+в streamPipe, а epoll горутина перекладывает его в сокет по мере того, как тот освобождается.
+Как только неотправленного набирается streamPendingLimit, epoll горутина перестает забирать
+данные и ждет EPOLLOUT, а Write горутины блокируется на заполненном pipe.
+
+	ctx.StreamAsync(func(w io.Writer) error {
+		return produce(w) // ctx трогать нельзя
+	})
+*/
+
+const (
+	streamFlushSize = 16 * 1024
+	// сколько неотправленного допускается в pipe и, отдельно, в буфере соединения
+	streamPendingLimit = 4 * streamFlushSize
+)
+
+var (
+	errStreamAborted = errors.New(`stream aborted: connection closed`)
+	errStreamPanic   = errors.New(`stream producer panic`)
+)
+
+// буфер между горутиной StreamAsync и epoll горутиной
+type streamPipe struct {
+	mu      sync.Mutex
+	cond    sync.Cond
+	buf     []byte
+	done    bool  // горутина закончила, после buf ничего не будет
+	err     error // с чем закончила
+	aborted bool  // соединение закрыто, писать некуда
+	notify  func()
+}
+
+// переход в потоковый режим. ResponseStatus и ResponseHeaders после этого уже не меняются
+func (c *RequestCtx) StartStream() {
+	if c.streaming {
+		return
+	}
+	c.streaming = true
+
+	if !c.http11 || (c.loop.shutdownState != httpShutdownNone) {
+		// без chunked конец тела можно обозначить только закрытием соединения
+		c.keepAlive = false
+	}
+
+	encoder := c.loop.compressStream(c)
+	c.outputBuf = appendResponseHeaders(c.outputBuf[:0], c, true)
+	c.encoder = encoder
+
+	// то, что обработчик успел записать до StartStream, становится первым куском
+	if body := c.ResponseBody; len(body) > 0 {
+		c.ResponseBody = nil
+		c.Write(body)
+	}
+}
+
+// потоковый ответ, тело которого пишет produce в отдельной горутине (см. выше).
+// ошибка produce обрывает ответ, как ctx.Error после StartStream
+func (c *RequestCtx) StreamAsync(produce func(w io.Writer) error) {
+	c.StartStream()
+	c.async = true
+
+	p := &streamPipe{}
+	p.cond.L = &p.mu
+	c.pipe = p
+
+	lp, wake := c.loop, httpAsync{ctx: c, connId: c.connId, pipe: p}
+	p.notify = func() {
+		lp.asyncDone(wake)
+	}
+
+	go func() {
+		var err error
+		defer func() {
+			if e := recover(); e != nil {
+				log.Printf("stream panic: %v\n%s", e, debug.Stack())
+				err = errStreamPanic
+			}
+			p.close(err)
+		}()
+
+		err = produce(p)
+	}()
+}
+
+func (c *RequestCtx) Streaming() bool {
+	return c.streaming
+}
+
+// отправка накопленного без ожидания streamFlushSize
+func (c *RequestCtx) Flush() {
+	if c.encoder != nil {
+		c.encoder.Flush()
+	}
+	if c.streaming {
+		c.writeStream()
+	}
+}
+
+func (c *RequestCtx) writeChunk(p []byte) (int, error) {
+	if c.streamBroken || statusBodiless(c.ResponseStatus) || (c.Method == MethodHEAD) {
+		return len(p), nil
+	} else if len(p) == 0 {
+		// пустой кусок означал бы конец тела
+		return 0, nil
+	}
+
+	if c.http11 {
+		c.outputBuf = strconv.AppendUint(c.outputBuf, uint64(len(p)), 16)
+		c.outputBuf = append(c.outputBuf, "\r\n"...)
+		c.outputBuf = append(c.outputBuf, p...)
+		c.outputBuf = append(c.outputBuf, "\r\n"...)
+	} else {
+		c.outputBuf = append(c.outputBuf, p...)
+	}
+	c.streamBytes += len(p)
+
+	if len(c.outputBuf) >= streamFlushSize {
+		c.writeStream()
+	}
+
+	return len(p), nil
+}
+
+// запись outputBuf в сокет, сколько получится без блокировки. остаток сдвигается в начало буфера.
+// для TLS outputBuf шифруется целиком, а не ушедший шифротекст копится в outputPending
+func (c *RequestCtx) writeStream() {
+	if c.tls != nil {
+		c.outputPending = c.tls.seal(c.outputPending, c.outputBuf)
+		c.outputBuf = c.outputBuf[:0]
+		c.outputPending = c.outputPending[c.writeSocket(c.outputPending):]
+		return
+	}
+
+	written := c.writeSocket(c.outputBuf)
+	c.outputBuf = c.outputBuf[:copy(c.outputBuf, c.outputBuf[written:])]
+}
+
+// сколько байт p удалось записать без блокировки. при ошибке все считается записанным (выброшенным)
+func (c *RequestCtx) writeSocket(p []byte) int {
+	written := 0
+
+	for written < len(p) {
+		n, err := syscall.Write(c.fd, p[written:])
+		if err != nil {
+			if errno, ok := err.(syscall.Errno); ok && (errno == syscall.EAGAIN) {
+				break
+			} else if ok && (errno == syscall.EINTR) {
+				continue
+			}
+			// соединение закроет respond, обработчик пусть дорабатывает вхолостую
+			c.streamBroken = true
+			c.keepAlive = false
+			return len(p)
+		}
+		written += n
+	}
+
+	return written
+}
+
+// хвост потокового ответа после выхода из обработчика: последний кусок и терминатор
+func (c *RequestCtx) finishStream() []byte {
+	if c.streamBroken {
+		return nil
+	}
+
+	if body := c.ResponseBody; len(body) > 0 {
+		// обработчик мог заполнить ResponseBody напрямую
+		c.ResponseBody = nil
+		c.Write(body)
+	}
+
+	if c.encoder != nil {
+		c.encoder.Close()
+		c.loop.releaseStreamEncoder(c.encoder)
+		c.encoder = nil
+	}
+
+	if c.http11 && !statusBodiless(c.ResponseStatus) && (c.Method != MethodHEAD) {
+		c.outputBuf = append(c.outputBuf, "0\r\n\r\n"...)
+	}
+
+	if c.tls != nil {
+		return c.tls.seal(c.outputPending, c.outputBuf)
+	}
+	return c.outputBuf
+}
+
+// записанное, но еще не принятое сокетом
+func (c *RequestCtx) streamPending() int {
+	return len(c.outputBuf) + len(c.outputPending)
+}
+
+// перекладывает данные из pipe в сокет, пока тот принимает. вызывается из epoll горутины,
+// когда в pipe появились данные (через eventfd) или сокет освободился (EPOLLOUT)
+func (lp *httpLoop) streamPump(ctx *RequestCtx) {
+	p := ctx.pipe
+
+	if ctx.streamPending() > 0 {
+		ctx.writeStream()
+	}
+
+	for !ctx.streamBroken && (ctx.streamPending() < streamPendingLimit) {
+		data, done, err := p.take(ctx.pipeBuf[:0])
+		ctx.pipeBuf = data
+		if len(data) > 0 {
+			ctx.Write(data)
+		}
+
+		if done {
+			if err != nil {
+				if err != errStreamPanic {
+					log.Println(`stream fail:`, err)
+				}
+				ctx.Error(500)
+			}
+			lp.streamEnd(ctx)
+			return
+		} else if len(data) == 0 {
+			// горутина разбудит, когда напишет еще
+			break
+		}
+	}
+
+	if ctx.streamBroken {
+		lp.streamEnd(ctx)
+		return
+	}
+
+	blocked := ctx.streamPending() >= streamPendingLimit
+	if blocked != ctx.pipeWatch {
+		if err := socketEpollWatchWrite(lp.l.epollFd, ctx.fd, blocked); err != nil {
+			log.Println("EpollCtl: ", err)
+			lp.closeConn(ctx, ConnCloseEpollCtlError)
+			return
+		}
+		ctx.pipeWatch = blocked
+	}
+
+	if blocked {
+		// сюда попадаем только по EPOLLOUT, то есть клиент читает
+		lp.setTimer(ctx, connTimeoutWrite)
+	} else {
+		// ждем горутину, а не клиента
+		lp.timers.Remove(ctx)
+	}
+}
+
+// горутина StreamAsync закончила (или соединение сломалось): обычное завершение потокового ответа
+func (lp *httpLoop) streamEnd(ctx *RequestCtx) {
+	ctx.pipe.abort()
+	ctx.pipe = nil
+	ctx.async = false
+	lp.timers.Remove(ctx)
+
+	if ctx.pipeWatch {
+		// respond включит снова, если хвост не влезет
+		ctx.pipeWatch = false
+		if err := socketEpollWatchWrite(lp.l.epollFd, ctx.fd, false); err != nil {
+			log.Println("EpollCtl: ", err)
+			lp.closeConn(ctx, ConnCloseEpollCtlError)
+			return
+		}
+	}
+
+	if lp.respond(ctx) {
+		// следующий запрос мог прийти, пока шел ответ
+		lp.serve(ctx)
+	}
+}
+
+// Write горутины StreamAsync. блокируется, пока в pipe streamPendingLimit и больше
+func (p *streamPipe) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for (len(p.buf) >= streamPendingLimit) && !p.aborted {
+		p.cond.Wait()
+	}
+	if p.aborted {
+		return 0, errStreamAborted
+	}
+
+	if len(p.buf) == 0 {
+		// epoll горутина забрала все и ждет только нас
+		p.notify()
+	}
+	p.buf = append(p.buf, b...)
+
+	return len(b), nil
+}
+
+func (p *streamPipe) close(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.done = true
+	p.err = err
+	if !p.aborted {
+		p.notify()
+	}
+}
+
+// забирает все накопленное в dst. done - горутина закончила и больше ничего не будет
+func (p *streamPipe) take(dst []byte) ([]byte, bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	dst = append(dst, p.buf...)
+	p.buf = p.buf[:0]
+	p.cond.Signal()
+
+	return dst, p.done, p.err
+}
+
+// соединение закрылось или ответ оборвался. ждущий Write вернет errStreamAborted
+func (p *streamPipe) abort() {
+	p.mu.Lock()
+	p.aborted = true
+	p.cond.Broadcast()
+	p.mu.Unlock()
+}
+
+// сколько байт тела ушло клиенту. для журналов
+func (c *RequestCtx) responseBodySize() int {
+	if c.streaming {
+		return c.streamBytes
+	}
+	return len(c.ResponseBody)
+}
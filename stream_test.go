@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"testing"
+	"time"
+)
+
+// Write блокируется на заполненном pipe, пока epoll горутина не заберет данные, и отпускается abort
+func TestStreamPipe(t *testing.T) {
+	p := &streamPipe{}
+	p.cond.L = &p.mu
+	notified := 0
+	p.notify = func() {
+		notified++
+	}
+
+	chunk := bytes.Repeat([]byte{'x'}, streamPendingLimit)
+	written := make(chan error, 1)
+
+	go func() {
+		for i := 0; i < 3; i++ {
+			if _, err := p.Write(chunk); err != nil {
+				written <- err
+				return
+			}
+		}
+		written <- nil
+	}()
+
+	select {
+	case err := <-written:
+		t.Fatalf(`Write did not block on a full pipe: %v`, err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	data, done, _ := p.take(nil)
+	if done || (len(data) != streamPendingLimit) {
+		t.Fatalf(`take: %d bytes, done %v`, len(data), done)
+	}
+
+	// вторая порция проходит, на третьей Write снова встает
+	time.Sleep(50 * time.Millisecond)
+	p.abort()
+
+	select {
+	case err := <-written:
+		if err != errStreamAborted {
+			t.Errorf(`Write after abort: %v`, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal(`Write still blocked after abort`)
+	}
+
+	p.close(nil)
+	if _, done, _ := p.take(nil); !done {
+		t.Error(`not done after close`)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if notified != 2 {
+		// только переходы пустой -> непустой
+		t.Errorf(`notified %d times, want 2`, notified)
+	}
+}
+
+// сжатый потоковый ответ не ломается, когда между его кусками горутина сжимает другой ответ
+func TestStreamOwnEncoder(t *testing.T) {
+	lp := &httpLoop{s: &HTTPServer{Compression: &CompressOptions{Level: gzip.BestSpeed}}}
+
+	newCtx := func() *RequestCtx {
+		ctx := &RequestCtx{}
+		ctx.Reset()
+		ctx.loop = lp
+		ctx.ResponseStatus = 200
+		ctx.RequestHeaders.Set(strAcceptEncoding, []byte(`gzip`))
+		return ctx
+	}
+
+	stream := newCtx()
+	stream.StartStream()
+	stream.Write([]byte(`{"first":`))
+
+	other := newCtx()
+	other.ResponseBody = bytes.Repeat([]byte(`{"other":1}`), 100)
+	lp.compressResponse(other)
+
+	stream.Write([]byte(`"second"}`))
+	out := stream.finishStream()
+
+	idx := bytes.Index(out, []byte("\r\n\r\n"))
+	if idx == -1 {
+		t.Fatalf(`no headers end in %q`, out)
+	}
+	r, err := gzip.NewReader(bytes.NewReader(out[idx+4:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	} else if string(body) != `{"first":"second"}` {
+		t.Errorf(`stream body %q`, body)
+	}
+}
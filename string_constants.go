@@ -7,19 +7,52 @@ var (
 	strConnection    = []byte(`connection`)
 	strClose         = []byte(`close`)
 	strKeepAlive     = []byte(`keep-alive`)
-	str11            = []byte(`/1.1`)
+	strIfMatch       = []byte(`if-match`)
+	strIfNoneMatch   = []byte(`if-none-match`)
+	strETag          = []byte(`ETag`)
+	strAllow         = []byte(`Allow`)
+	strAuthorization = []byte(`authorization`)
+	strContentType   = []byte(`Content-Type`)
+	strXRequestId    = []byte(`X-Request-Id`)
 
-	line200 = []byte("HTTP/1.1 200 OK\r\n")
-	line400 = []byte("HTTP/1.1 400 Bad Request\r\n")
-	line404 = []byte("HTTP/1.1 404 Not Found\r\n")
-	line500 = []byte("HTTP/1.1 500 Internal Server Error\r\n")
+	strAcceptEncoding  = []byte(`Accept-Encoding`)
+	strContentEncoding = []byte(`Content-Encoding`)
+	strVary            = []byte(`Vary`)
+	strAsterisk        = []byte(`*`)
+	strTextPrefix      = []byte(`text/`)
+	strJSON            = []byte(`json`)
 
-	emptyResponseBody = []byte(`{}`)
-	strUsers          = []byte(`users`)
-	strVisits         = []byte(`visits`)
-	strLocations      = []byte(`locations`)
-	strAvg            = []byte(`avg`)
-	strNew            = []byte(`new`)
+	strTransferEncoding = []byte(`transfer-encoding`)
+	strChunked          = []byte(`chunked`)
+	strExpect           = []byte(`expect`)
+	str100Continue      = []byte(`100-continue`)
+
+	strBearer          = []byte(`Bearer`)
+	strBearerPrefix    = []byte(`Bearer `)
+	strWWWAuthenticate = []byte(`WWW-Authenticate`)
+	strRetryAfter      = []byte(`Retry-After`)
+	strOne             = []byte(`1`)
+	str11              = []byte(`/1.1`)
+
+	responseTooManyConnections = []byte("HTTP/1.1 503 Service Unavailable\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+	responseContinue           = []byte("HTTP/1.1 100 Continue\r\n\r\n")
+	responseRequestTimeout     = []byte("HTTP/1.1 408 Request Timeout\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+
+	emptyResponseBody     = []byte(`{}`)
+	contentTypeZip        = []byte(`application/zip`)
+	contentTypePrometheus = []byte(`text/plain; version=0.0.4; charset=utf-8`)
+	contentTypeText       = []byte(`text/plain; charset=utf-8`)
+	contentTypeBinary     = []byte(`application/octet-stream`)
+	strWeakETagPrefix     = []byte(`W/`)
+	strPathAdmin          = []byte(`/admin/`)
+	strPathDebug          = []byte(`/debug/`)
+	strPathHealthz        = []byte(`/healthz`)
+	strPathReadyz         = []byte(`/readyz`)
+	strPathVersion        = []byte(`/version`)
+	strPathMetrics        = []byte(`/metrics`)
+	strUsers              = []byte(`users`)
+	strVisits             = []byte(`visits`)
+	strLocations          = []byte(`locations`)
 
 	strId         = []byte(`id`)
 	strLocation   = []byte(`location`)
@@ -40,4 +73,6 @@ var (
 	strToDistance = []byte(`toDistance`)
 	strFromAge    = []byte(`fromAge`)
 	strToAge      = []byte(`toAge`)
+	strSeconds    = []byte(`seconds`)
+	strDebug      = []byte(`debug`)
 )
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"syscall"
+	"time"
+)
+
+/*
+Таймауты соединений.
+
+Колесо таймеров на каждую epoll горутину: соединения лежат в интрузивных списках
+по слотам, так что взвод и снятие таймера не аллоцируют и стоят O(1).
+EpollWait просыпается раз в timerWheelTick, точность таймаутов такая же.
+*/
+
+type (
+	connTimeoutKind int
+
+	connTimer struct {
+		kind     connTimeoutKind
+		deadline int64 // UnixNano
+		slot     int
+		prev     *RequestCtx
+		next     *RequestCtx
+	}
+
+	timerWheel struct {
+		slots    [timerWheelSlots]*RequestCtx
+		lastTick int64 // номер последнего обработанного тика
+	}
+)
+
+const (
+	connTimeoutNone = connTimeoutKind(iota)
+	connTimeoutHeader
+	connTimeoutBody
+	connTimeoutIdle
+	connTimeoutWrite
+)
+
+const (
+	timerWheelTick  = 100 * time.Millisecond
+	timerWheelSlots = 512
+)
+
+func (w *timerWheel) Init(now int64) {
+	w.lastTick = now / int64(timerWheelTick)
+}
+
+func (w *timerWheel) Add(ctx *RequestCtx, kind connTimeoutKind, deadline int64) {
+	w.Remove(ctx)
+
+	// округляем вверх: Expire доходит до слота не раньше срока, иначе таймер со сроком
+	// в конце текущего тика пропустил бы проход и ждал бы целый оборот
+	tick := (deadline + int64(timerWheelTick) - 1) / int64(timerWheelTick)
+	if tick <= w.lastTick {
+		// этот слот Expire уже прошел, иначе таймер ждал бы целый оборот
+		tick = w.lastTick + 1
+	}
+	slot := int(tick % timerWheelSlots)
+
+	t := &ctx.timer
+	t.kind = kind
+	t.deadline = deadline
+	t.slot = slot
+	t.prev = nil
+	t.next = w.slots[slot]
+	if t.next != nil {
+		t.next.timer.prev = ctx
+	}
+	w.slots[slot] = ctx
+}
+
+func (w *timerWheel) Remove(ctx *RequestCtx) {
+	t := &ctx.timer
+	if t.kind == connTimeoutNone {
+		return
+	}
+
+	if t.prev != nil {
+		t.prev.timer.next = t.next
+	} else {
+		w.slots[t.slot] = t.next
+	}
+	if t.next != nil {
+		t.next.timer.prev = t.prev
+	}
+
+	t.kind = connTimeoutNone
+	t.prev = nil
+	t.next = nil
+}
+
+// вызывает cb для всех истекших таймеров. таймер снимается до вызова cb
+func (w *timerWheel) Expire(now int64, cb func(ctx *RequestCtx, kind connTimeoutKind)) {
+	tick := now / int64(timerWheelTick)
+
+	from := w.lastTick + 1
+	if tick-from >= timerWheelSlots {
+		// горутина долго спала, хватит одного полного оборота
+		from = tick - timerWheelSlots + 1
+	}
+	w.lastTick = tick
+
+	for ; from <= tick; from++ {
+		slot := int(from % timerWheelSlots)
+
+		for ctx := w.slots[slot]; ctx != nil; {
+			next := ctx.timer.next
+			if ctx.timer.deadline <= now {
+				kind := ctx.timer.kind
+				w.Remove(ctx)
+				cb(ctx, kind)
+			}
+			// иначе таймер с одного из следующих оборотов
+			ctx = next
+		}
+	}
+}
+
+func (s *HTTPServer) timeout(kind connTimeoutKind) time.Duration {
+	switch kind {
+	case connTimeoutHeader:
+		return s.ReadHeaderTimeout
+	case connTimeoutBody:
+		return s.BodyTimeout
+	case connTimeoutIdle, connTimeoutWrite:
+		return s.IdleTimeout
+	}
+	return 0
+}
+
+func (lp *httpLoop) setTimer(ctx *RequestCtx, kind connTimeoutKind) {
+	if (ctx.timer.kind == kind) && ((kind == connTimeoutHeader) || (kind == connTimeoutBody)) {
+		// новые байты запроса срок не продлевают, иначе медленный клиент держал бы соединение вечно
+		return
+	}
+
+	timeout := lp.s.timeout(kind)
+	if timeout <= 0 {
+		lp.timers.Remove(ctx)
+		return
+	}
+
+	lp.timers.Add(ctx, kind, lp.now+int64(timeout))
+}
+
+// таймер дочитывания запроса после служебной записи
+func (lp *httpLoop) setReadTimer(ctx *RequestCtx) {
+	if ctx.state >= parseRequestStateBody {
+		lp.setTimer(ctx, connTimeoutBody)
+	} else {
+		lp.setTimer(ctx, connTimeoutHeader)
+	}
+}
+
+func (lp *httpLoop) expire(ctx *RequestCtx, kind connTimeoutKind) {
+	if ((kind == connTimeoutHeader) || (kind == connTimeoutBody)) && (ctx.inputLen > 0) {
+		// запрос начат, но не дослан. отвечаем как получится, не дожидаясь сокета
+		response := responseRequestTimeout
+		if ctx.tls != nil {
+			// до конца рукопожатия ответить нечем
+			response = ctx.tls.seal(nil, response)
+		}
+		if len(response) > 0 {
+			syscall.Write(ctx.fd, response)
+		}
+	}
+
+	lp.closeConn(ctx, ConnCloseTimeout)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestTimerWheel(t *testing.T) {
+	const tick = timerWheelTick
+
+	type op struct {
+		ctx    int
+		after  time.Duration // от начала. 0 - снять таймер
+		expire bool          // вместо взвода - Expire на момент after
+		fired  []int         // что должен вызвать Expire
+	}
+
+	tests := []struct {
+		name string
+		ops  []op
+	}{
+		{name: `fires on deadline`, ops: []op{
+			{ctx: 0, after: time.Second},
+			{expire: true, after: 500 * time.Millisecond},
+			{expire: true, after: time.Second, fired: []int{0}},
+			{expire: true, after: 2 * time.Second},
+		}},
+		{name: `same slot next revolution`, ops: []op{
+			{ctx: 0, after: time.Second},
+			{ctx: 1, after: time.Second + timerWheelSlots*tick},
+			{expire: true, after: time.Second, fired: []int{0}},
+			{expire: true, after: time.Second + (timerWheelSlots-1)*tick},
+			{expire: true, after: time.Second + timerWheelSlots*tick, fired: []int{1}},
+		}},
+		{name: `remove from middle of slot`, ops: []op{
+			{ctx: 0, after: time.Second},
+			{ctx: 1, after: time.Second},
+			{ctx: 2, after: time.Second},
+			{ctx: 3, after: time.Second},
+			{ctx: 2},
+			{ctx: 0},
+			{expire: true, after: time.Second, fired: []int{1, 3}},
+		}},
+		{name: `re-add moves timer`, ops: []op{
+			{ctx: 0, after: time.Second},
+			{ctx: 0, after: 3 * time.Second},
+			{expire: true, after: 2 * time.Second},
+			{expire: true, after: 3 * time.Second, fired: []int{0}},
+		}},
+		{name: `deadline inside current tick`, ops: []op{
+			{expire: true, after: tick + tick/4},
+			{ctx: 0, after: tick + tick/2},
+			{expire: true, after: 2 * tick, fired: []int{0}},
+		}},
+		{name: `deadline later in the tick being expired`, ops: []op{
+			{ctx: 0, after: tick + tick/2},
+			{expire: true, after: tick + tick/4},
+			{expire: true, after: 2 * tick, fired: []int{0}},
+		}},
+		{name: `long sleep`, ops: []op{
+			{ctx: 0, after: time.Second},
+			{ctx: 1, after: 100 * time.Second},
+			{ctx: 2, after: 300 * time.Second},
+			{expire: true, after: 200 * time.Second, fired: []int{0, 1}},
+			{expire: true, after: 300 * time.Second, fired: []int{2}},
+		}},
+	}
+
+	// не с нуля, чтобы слоты не совпадали с началом колеса
+	start := int64(1e12)
+
+	for _, test := range tests {
+		var w timerWheel
+		w.Init(start)
+
+		ctxs := make([]*RequestCtx, 4)
+		for i := range ctxs {
+			ctxs[i] = &RequestCtx{}
+		}
+
+		for step, op := range test.ops {
+			now := start + int64(op.after)
+
+			if !op.expire {
+				if op.after == 0 {
+					w.Remove(ctxs[op.ctx])
+				} else {
+					w.Add(ctxs[op.ctx], connTimeoutIdle, now)
+				}
+				continue
+			}
+
+			var fired []int
+			w.Expire(now, func(ctx *RequestCtx, kind connTimeoutKind) {
+				if kind != connTimeoutIdle {
+					t.Errorf(`%s: step %d: kind %d`, test.name, step, kind)
+				}
+				if ctx.timer.kind != connTimeoutNone {
+					t.Errorf(`%s: step %d: timer not removed before callback`, test.name, step)
+				}
+				for i := range ctxs {
+					if ctxs[i] == ctx {
+						fired = append(fired, i)
+					}
+				}
+			})
+			sort.Ints(fired)
+
+			if !reflect.DeepEqual(fired, op.fired) {
+				t.Errorf(`%s: step %d: fired %v, want %v`, test.name, step, fired, op.fired)
+			}
+		}
+	}
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+/*
+TLS на своих epoll горутинах.
+
+crypto/tls умеет работать только поверх блокирующего net.Conn, поэтому на каждое TLS соединение
+заводится горутина с tls.Conn поверх tlsNetConn - адаптера над буферами в памяти.
+Горутина и epoll горутина передают управление друг другу через каналы и никогда не работают
+одновременно (по сути это сопрограмма), так что буферы делятся без блокировок:
+
+	epoll горутина                       tls горутина
+	read() из сокета -> in
+	step()  ---------------------------> Handshake()/Read() читает in
+	                                     нужен еще шифротекст или готов открытый текст
+	        <--------------------------- yield
+	out -> write() в сокет, plain -> inputBuf
+
+Все вызовы tls.Conn (Handshake, Read, Write, Close) делает только tls горутина: epoll горутина
+кладет в op, что нужно сделать, и передает ей управление. Ответ шифруется уже целиком собранным
+(seal, op tlsOpWrite) в out и дальше отправляется обычным образом через outputPending.
+
+Между запросами tls горутина обычно стоит внутри tls.Conn.Read в ожидании шифротекста. Чтобы
+записать ответ (408 по таймауту, close_notify при закрытии), это ожидание прерывается: tlsNetConn.Read
+возвращает os.ErrDeadlineExceeded, как при истекшем SetReadDeadline. Такую ошибку tls.Conn считает
+временной: недочитанная запись остается у него, и следующий Read продолжит с того же места.
+
+Таймауты, закрытие соединения и остановка сервера работают как для открытых соединений.
+*/
+
+const (
+	tlsInBufSize    = 16*1024 + 512 // запись TLS целиком
+	tlsPlainBufSize = 16 * 1024
+
+	tlsSelfSignedValidity = 365 * 24 * time.Hour
+)
+
+const (
+	tlsOpRead = tlsOp(iota)
+	tlsOpWrite
+	tlsOpClose
+)
+
+var (
+	errTLSNotConfigured = errors.New(`tls: listen address needs HTTPServer.TLSConfig`)
+)
+
+type (
+	tlsOp int
+
+	tlsConn struct {
+		conn *tls.Conn
+
+		resume chan struct{}
+		yield  chan struct{}
+
+		op      tlsOp  // что tls горутина делает по следующему resume, если не стоит внутри Read
+		opData  []byte // открытый текст для tlsOpWrite
+		opAlert bool   // tlsOpClose: отправить close_notify
+
+		in    []byte // шифротекст от клиента, еще не прочитанный tls
+		inPos int
+		out   []byte // шифротекст для клиента. неотправленный хвост лежит в ctx.outputPending
+
+		plain    []byte // расшифрованное горутиной
+		plainPos int
+		plainLen int
+
+		handshakeDone bool
+		wantInput     bool  // горутина стоит внутри Handshake/Read и ждет шифротекст
+		interrupt     bool  // прервать ожидание шифротекста, чтобы выполнить op
+		closing       bool  // рукопожатие надо оборвать
+		done          bool  // горутина завершилась
+		err           error // ошибка tls, после нее соединение только закрывать
+	}
+
+	// net.Conn для tls.Conn поверх буферов tlsConn
+	tlsNetConn struct {
+		t *tlsConn
+	}
+
+	tlsAddr struct{}
+
+	// сертификат, который можно заменить на лету (SIGHUP)
+	TLSCertStore struct {
+		CertFile string
+		KeyFile  string
+
+		mu   sync.RWMutex
+		cert *tls.Certificate
+	}
+)
+
+func newTLSConn(config *tls.Config) *tlsConn {
+	t := &tlsConn{
+		resume: make(chan struct{}),
+		yield:  make(chan struct{}),
+		in:     make([]byte, 0, tlsInBufSize),
+		plain:  make([]byte, tlsPlainBufSize),
+	}
+	t.conn = tls.Server(&tlsNetConn{t: t}, config)
+
+	go t.run()
+
+	return t
+}
+
+// тело tls горутины. работает только между resume и yield
+func (t *tlsConn) run() {
+	<-t.resume
+
+	if t.err = t.conn.Handshake(); t.err == nil {
+		t.handshakeDone = true
+
+		for !t.done {
+			switch t.op {
+			case tlsOpRead:
+				n, err := t.conn.Read(t.plain)
+				t.plainPos, t.plainLen = 0, n
+				if (err != nil) && (err != os.ErrDeadlineExceeded) {
+					t.err = err
+					t.done = true
+				}
+
+			case tlsOpWrite:
+				if _, err := t.conn.Write(t.opData); err != nil {
+					t.err = err
+					t.done = true
+				}
+
+			case tlsOpClose:
+				if t.opAlert {
+					// close_notify уходит в out
+					t.conn.Close()
+				}
+				t.done = true
+			}
+
+			if !t.done {
+				t.yield <- struct{}{}
+				<-t.resume
+			}
+		}
+	}
+
+	t.done = true
+	t.yield <- struct{}{}
+}
+
+// передать управление tls горутине до ее следующей остановки
+func (t *tlsConn) step() {
+	t.resume <- struct{}{}
+	<-t.yield
+}
+
+// выполнить op в tls горутине. если она ждет шифротекст внутри Read, ожидание сначала прерывается
+func (t *tlsConn) exec(op tlsOp) {
+	if t.wantInput {
+		t.interrupt = true
+		t.step()
+		t.interrupt = false
+	}
+
+	if !t.done {
+		t.op = op
+		t.step()
+		t.op = tlsOpRead
+	}
+}
+
+// расшифрованные данные в dst. 0, nil - нужен еще шифротекст из сокета в t.in
+func (t *tlsConn) Read(dst []byte) (int, error) {
+	for {
+		if t.plainPos < t.plainLen {
+			n := copy(dst, t.plain[t.plainPos:t.plainLen])
+			t.plainPos += n
+			return n, nil
+		} else if t.done {
+			if t.err == nil {
+				t.err = io.EOF
+			}
+			return 0, t.err
+		} else if t.wantInput && (t.inPos == len(t.in)) {
+			return 0, nil
+		}
+
+		// op здесь всегда tlsOpRead
+		t.step()
+	}
+}
+
+// буфер под очередное чтение шифротекста из сокета. вызывается, только когда Read вернул 0, nil
+func (t *tlsConn) inputBuf() []byte {
+	t.in, t.inPos = t.in[:0], 0
+	return t.in[:cap(t.in)]
+}
+
+func (t *tlsConn) inputRead(n int) {
+	t.in = t.in[:n]
+}
+
+// шифрование p. результат дописывается к еще не отправленному шифротексту pending (он должен лежать в конце t.out)
+func (t *tlsConn) seal(pending, p []byte) []byte {
+	if len(pending) == 0 {
+		t.out = t.out[:0]
+	}
+	start := len(t.out) - len(pending)
+
+	if !t.handshakeDone || t.done {
+		return t.out[start:]
+	}
+
+	t.opData = p
+	t.exec(tlsOpWrite)
+	t.opData = nil
+
+	return t.out[start:]
+}
+
+// close_notify (если есть куда) и остановка горутины. возвращает шифротекст, который стоит попытаться отправить
+func (t *tlsConn) close(pending []byte) []byte {
+	if t.done {
+		return nil
+	} else if !t.handshakeDone {
+		// рукопожатие получит EOF из tlsNetConn.Read и завершится с ошибкой
+		t.closing = true
+		t.step()
+		return nil
+	}
+
+	// alert не может обогнать неотправленный хвост ответа
+	t.opAlert = len(pending) == 0
+	if t.opAlert {
+		t.out = t.out[:0]
+	}
+	t.exec(tlsOpClose)
+
+	if !t.opAlert {
+		return nil
+	}
+	return t.out
+}
+
+func (c *tlsNetConn) Read(p []byte) (int, error) {
+	t := c.t
+
+	for t.inPos == len(t.in) {
+		if t.closing {
+			return 0, io.EOF
+		} else if t.interrupt {
+			// epoll горутине нужна запись. недочитанную запись tls.Conn сохранит у себя
+			return 0, os.ErrDeadlineExceeded
+		}
+
+		t.wantInput = true
+		t.yield <- struct{}{}
+		<-t.resume
+		t.wantInput = false
+	}
+
+	n := copy(p, t.in[t.inPos:])
+	t.inPos += n
+
+	return n, nil
+}
+
+func (c *tlsNetConn) Write(p []byte) (int, error) {
+	c.t.out = append(c.t.out, p...)
+	return len(p), nil
+}
+
+// сокетом владеет epoll горутина, закрывает его она же
+func (c *tlsNetConn) Close() error                       { return nil }
+func (c *tlsNetConn) LocalAddr() net.Addr                { return tlsAddr{} }
+func (c *tlsNetConn) RemoteAddr() net.Addr               { return tlsAddr{} }
+func (c *tlsNetConn) SetDeadline(t time.Time) error      { return nil }
+func (c *tlsNetConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *tlsNetConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func (tlsAddr) Network() string { return `tcp` }
+func (tlsAddr) String() string  { return `epoll` }
+
+// загрузка (или перезагрузка) сертификата из CertFile и KeyFile. при ошибке остается старый
+func (s *TLSCertStore) Load() error {
+	cert, err := tls.LoadX509KeyPair(s.CertFile, s.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.cert = &cert
+	s.mu.Unlock()
+
+	return nil
+}
+
+func (s *TLSCertStore) Set(cert *tls.Certificate) {
+	s.mu.Lock()
+	s.cert = cert
+	s.mu.Unlock()
+}
+
+func (s *TLSCertStore) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	cert := s.cert
+	s.mu.RUnlock()
+
+	if cert == nil {
+		return nil, errors.New(`tls: no certificate loaded`)
+	}
+	return cert, nil
+}
+
+// конфиг для HTTPServer.TLSConfig: сертификат из store, ALPN только http/1.1
+func (s *TLSCertStore) Config() *tls.Config {
+	return &tls.Config{
+		GetCertificate: s.GetCertificate,
+		NextProtos:     []string{`http/1.1`},
+		MinVersion:     tls.VersionTLS12,
+	}
+}
+
+// самоподписанный сертификат для localhost, 127.0.0.1 и ::1. для тестов и локальной разработки
+func tlsSelfSignedCert() (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: `localhost`},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(tlsSelfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{`localhost`},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// чтение через TLS: расшифрованное дописывается в inputBuf. false - данных пока нет или соединение закрыто
+func (lp *httpLoop) readTLS(ctx *RequestCtx) bool {
+	t := ctx.tls
+
+	for {
+		// outputPending пуст, так что все в t.out уже отправлено
+		t.out = t.out[:0]
+
+		n, err := t.Read(ctx.inputBuf[ctx.inputLen:])
+		ctx.inputLen += n
+
+		if len(t.out) > 0 {
+			// рукопожатие, тикеты сессий, алерты
+			if !lp.writeInterim(ctx, t.out) {
+				return false
+			} else if len(ctx.outputPending) > 0 {
+				// прочитанное разберем после EPOLLOUT
+				return false
+			}
+		}
+
+		if n > 0 {
+			return true
+		} else if err == io.EOF {
+			lp.closeConn(ctx, ConnCloseEOF)
+			return false
+		} else if err != nil {
+			lp.closeConn(ctx, ConnCloseTLSError)
+			return false
+		}
+
+		// tls нужен еще шифротекст
+		nbytes, ok := lp.readSocket(ctx, t.inputBuf())
+		if !ok {
+			return false
+		}
+		t.inputRead(nbytes)
+	}
+}
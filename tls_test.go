@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var errTLSTestRawEOF = errors.New(`raw EOF`)
+
+// сокет закрылся без close_notify: tls.Conn.Read вернет не io.EOF, а errTLSTestRawEOF
+type tlsTestConn struct {
+	net.Conn
+}
+
+func (c tlsTestConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if err == io.EOF {
+		err = errTLSTestRawEOF
+	}
+	return n, err
+}
+
+// самоподписанный сертификат в CertFile и KeyFile. возвращает его для проверки клиентом
+func tlsTestWriteCert(t *testing.T, store *TLSCertStore) *x509.Certificate {
+	cert, err := tlsSelfSignedCert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: `CERTIFICATE`, Bytes: cert.Certificate[0]})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: `EC PRIVATE KEY`, Bytes: key})
+	if err := os.WriteFile(store.CertFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	} else if err := os.WriteFile(store.KeyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed
+}
+
+// рукопожатие с проверкой сертификата по roots. клиент предлагает h2, но договориться должен о http/1.1
+func tlsTestDial(t *testing.T, path string, roots *x509.CertPool) *tls.Conn {
+	var (
+		conn net.Conn
+		err  error
+	)
+	for i := 0; i < 100; i++ {
+		// сервер мог еще не успеть создать сокет
+		if conn, err = net.Dial(`unix`, path); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := tls.Client(tlsTestConn{conn}, &tls.Config{
+		RootCAs:    roots,
+		ServerName: `localhost`,
+		NextProtos: []string{`h2`, `http/1.1`},
+	})
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if err := client.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if proto := client.ConnectionState().NegotiatedProtocol; proto != `http/1.1` {
+		t.Errorf(`ALPN %q, want http/1.1`, proto)
+	}
+
+	return client
+}
+
+func tlsTestRequest(t *testing.T, conn *tls.Conn, r *bufio.Reader, request string) {
+	if _, err := conn.Write([]byte(request)); err != nil {
+		t.Fatal(err)
+	}
+
+	status, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	} else if status != "HTTP/1.1 200 OK\r\n" {
+		t.Fatalf(`status line %q`, status)
+	}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		} else if line == "\r\n" {
+			break
+		}
+	}
+
+	body := make([]byte, 2)
+	if _, err := io.ReadFull(r, body); err != nil {
+		t.Fatal(err)
+	} else if string(body) != `ok` {
+		t.Fatalf(`body %q`, body)
+	}
+}
+
+// настоящий сервер на tls: адресе: рукопожатие через epoll горутину, ALPN, замена сертификата
+// как по SIGHUP, close_notify при закрытии соединения сервером и ответ по таймауту, пока
+// tls горутина ждет шифротекст
+func TestTLSHandshake(t *testing.T) {
+	dir := t.TempDir()
+	store := &TLSCertStore{CertFile: filepath.Join(dir, `cert.pem`), KeyFile: filepath.Join(dir, `key.pem`)}
+
+	certA := tlsTestWriteCert(t, store)
+	if err := store.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &HTTPServer{
+		Handler: func(ctx *RequestCtx) {
+			ctx.ResponseBody = []byte(`ok`)
+		},
+		TLSConfig:         store.Config(),
+		Listeners:         1,
+		MaxRequestSize:    4096,
+		ReadHeaderTimeout: 300 * time.Millisecond,
+	}
+
+	path := filepath.Join(dir, `tls.sock`)
+	addrs, err := ParseListenAddrs(`tls:unix:` + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	served := make(chan error, 1)
+	go func() {
+		served <- s.ListenAndServe(addrs)
+	}()
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		s.Shutdown(ctx)
+		if err := <-served; err != nil {
+			t.Error(err)
+		}
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(certA)
+
+	const get = "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"
+
+	first := tlsTestDial(t, path, roots)
+	defer first.Close()
+	firstReader := bufio.NewReader(first)
+	tlsTestRequest(t, first, firstReader, get)
+	if peer := first.ConnectionState().PeerCertificates[0]; !bytes.Equal(peer.Raw, certA.Raw) {
+		t.Error(`first connection got unexpected certificate`)
+	}
+
+	// то же, что делает tlsReload по SIGHUP
+	certB := tlsTestWriteCert(t, store)
+	if err := store.Load(); err != nil {
+		t.Fatal(err)
+	}
+	roots.AddCert(certB)
+
+	second := tlsTestDial(t, path, roots)
+	defer second.Close()
+	if peer := second.ConnectionState().PeerCertificates[0]; !bytes.Equal(peer.Raw, certB.Raw) {
+		t.Error(`new connection did not get the reloaded certificate`)
+	}
+
+	// открытое до замены соединение продолжает работать
+	tlsTestRequest(t, first, firstReader, get)
+
+	// сервер закрывает соединение после ответа и должен успеть отправить close_notify
+	secondReader := bufio.NewReader(second)
+	tlsTestRequest(t, second, secondReader, "GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	if _, err := secondReader.ReadByte(); err != io.EOF {
+		t.Errorf(`read after Connection: close: %v, want io.EOF after close_notify`, err)
+	}
+
+	// недосланный запрос: 408 и close_notify шифруются, пока tls горутина стоит внутри Read
+	third := tlsTestDial(t, path, roots)
+	defer third.Close()
+	if _, err := third.Write([]byte("GET / HTTP/1.1\r\nHo")); err != nil {
+		t.Fatal(err)
+	}
+	response, err := io.ReadAll(third)
+	if err != nil {
+		t.Errorf(`read after timeout: %v, want io.EOF after close_notify`, err)
+	}
+	if !bytes.HasPrefix(response, []byte("HTTP/1.1 408 ")) {
+		t.Errorf(`response on timeout %q`, response)
+	}
+}
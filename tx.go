@@ -0,0 +1,381 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"strconv"
+)
+
+/*
+POST /tx
+
+Упорядоченный список операций, применяемых атомарно (все или ничего):
+	{"ops": [
+		{"op": "create", "entity": "users", "data": {...}},
+		{"op": "update", "entity": "visits", "id": 12, "data": {"user": 5, "location": 7}},
+		{"op": "delete", "entity": "visits", "id": 13, "if_match": "\"<ETag>\""}
+	]}
+
+if_match у update и delete работает как заголовок If-Match (строгое сравнение): не совпал - 412.
+
+Все операции сначала разбираются и проверяются, затем применяются под одним dbLock.Lock.
+Если какая-то из них не применилась (или обработчик упал с паникой), уже примененные откатываются
+в обратном порядке, а в ответе возвращается ее статус и {"failed_op": <номер>}.
+Читатели в это время ждут на dbLock.RLock, поэтому промежуточных состояний не видят.
+*/
+
+const (
+	txMaxOps = 1000
+)
+
+type (
+	txOpKind   int
+	txOpEntity int
+)
+
+const (
+	txOpCreate = txOpKind(iota)
+	txOpUpdate
+	txOpDelete
+)
+
+const (
+	txOpEntityUser = txOpEntity(iota)
+	txOpEntityLocation
+	txOpEntityVisit
+)
+
+type (
+	txRequest struct {
+		Ops []struct {
+			Op      string          `json:"op"`
+			Entity  string          `json:"entity"`
+			Id      int64           `json:"id"`
+			Data    json.RawMessage `json:"data"`
+			IfMatch *string         `json:"if_match"`
+		} `json:"ops"`
+	}
+
+	txOp struct {
+		kind    txOpKind
+		entity  txOpEntity
+		id      int32
+		ifMatch []byte // nil - без проверки версии
+
+		user     User
+		location Location
+		visit    Visit
+	}
+)
+
+func reqTx(ctx *RequestCtx, req *RequestParams) {
+	// POST /tx для атомарного применения нескольких изменений
+
+	ops, failedOp := txParse(ctx.Body)
+	status := 400
+
+	if ops != nil {
+		failedOp, status = txApplyLocked(ops)
+	}
+
+	if status != 200 {
+		ctx.ResponseStatus = status
+		if failedOp >= 0 {
+			buf := append(ctx.UserBuf[:0], `{"failed_op":`...)
+			buf = strconv.AppendInt(buf, int64(failedOp), 10)
+			buf = append(buf, '}')
+			ctx.ResponseBody = buf
+		}
+		return
+	}
+
+	ctx.ResponseBody = emptyResponseBody
+}
+
+// разбор и проверка полей всех операций. при ошибке ops == nil, failedOp - номер кривой операции или -1
+func txParse(body []byte) (ops []txOp, failedOp int) {
+	var req txRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, -1
+	} else if (len(req.Ops) == 0) || (len(req.Ops) > txMaxOps) {
+		return nil, -1
+	}
+
+	ops = make([]txOp, len(req.Ops))
+
+	for i, reqOp := range req.Ops {
+		op := &ops[i]
+
+		switch reqOp.Op {
+		case `create`:
+			op.kind = txOpCreate
+		case `update`:
+			op.kind = txOpUpdate
+		case `delete`:
+			op.kind = txOpDelete
+		default:
+			return nil, i
+		}
+
+		switch reqOp.Entity {
+		case string(strUsers):
+			op.entity = txOpEntityUser
+		case string(strLocations):
+			op.entity = txOpEntityLocation
+		case string(strVisits):
+			op.entity = txOpEntityVisit
+		default:
+			return nil, i
+		}
+
+		if op.kind == txOpCreate {
+			// id берется из data, как и в POST /<entity>/new
+			if reqOp.Id != 0 {
+				return nil, i
+			}
+		} else if (reqOp.Id <= 0) || (reqOp.Id > math.MaxInt32) {
+			return nil, i
+		} else {
+			op.id = int32(reqOp.Id)
+		}
+
+		if reqOp.IfMatch != nil {
+			if op.kind == txOpCreate {
+				return nil, i
+			}
+			op.ifMatch = []byte(*reqOp.IfMatch)
+		}
+
+		if op.kind == txOpDelete {
+			if len(reqOp.Data) != 0 {
+				return nil, i
+			}
+			continue
+		}
+
+		update := op.kind == txOpUpdate
+		ok := false
+
+		switch op.entity {
+		case txOpEntityUser:
+			ok = op.user.Parse(reqOp.Data) && op.user.CheckFields(update)
+			if !update {
+				op.id = op.user.Id
+			}
+		case txOpEntityLocation:
+			ok = op.location.Parse(reqOp.Data) && op.location.CheckFields(update)
+			if !update {
+				op.id = op.location.Id
+			}
+		case txOpEntityVisit:
+			ok = op.visit.Parse(reqOp.Data) && op.visit.CheckFields(update)
+			if !update {
+				op.id = op.visit.Id
+			}
+		}
+
+		if !ok {
+			return nil, i
+		}
+	}
+
+	return ops, -1
+}
+
+func txApplyLocked(ops []txOp) (failedOp int, status int) {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+
+	return txApply(ops)
+}
+
+// применение операций с откатом при ошибке. вызывать под dbLock.Lock
+func txApply(ops []txOp) (failedOp int, status int) {
+	undo := make([]func(), 0, len(ops))
+
+	// при панике status остается 0, так что примененное откатывается и в этом случае,
+	// а саму панику дальше ловит RecoveryMiddleware
+	defer func() {
+		if status != 200 {
+			for j := len(undo) - 1; j >= 0; j-- {
+				undo[j]()
+			}
+		}
+	}()
+
+	for i := range ops {
+		undoOp, opStatus := txApplyOp(&ops[i])
+		if opStatus != 200 {
+			return i, opStatus
+		}
+		undo = append(undo, undoOp)
+	}
+
+	return -1, 200
+}
+
+// применяет одну операцию и возвращает функцию для ее отката
+func txApplyOp(op *txOp) (undo func(), status int) {
+	id := op.id
+
+	// версия для if_match. 0 - сущности нет
+	var version uint64
+	switch op.entity {
+	case txOpEntityUser:
+		if user := indexUser.Get(id); user != nil {
+			version = user.Version
+		}
+	case txOpEntityLocation:
+		if location := indexLocation.Get(id); location != nil {
+			version = location.Version
+		}
+	case txOpEntityVisit:
+		if visit := indexVisit.Get(id); visit != nil {
+			version = visit.Version
+		}
+	}
+	if (op.ifMatch != nil) && (version != 0) && !etagMatch(op.ifMatch, version, true) {
+		return nil, 412
+	}
+
+	switch op.entity {
+	case txOpEntityUser:
+		switch op.kind {
+		case txOpCreate:
+			if !indexUser.Add(&op.user) {
+				return nil, 400
+			}
+			return func() { indexUser.Delete(id) }, 200
+
+		case txOpUpdate:
+			user := indexUser.Get(id)
+			if user == nil {
+				return nil, 404
+			}
+			old := txUserSnapshot(user)
+			user.Update(&op.user)
+			return func() {
+				user.Update(&old)
+				user.Version = old.Version
+			}, 200
+
+		case txOpDelete:
+			user := indexUser.Get(id)
+			if user == nil {
+				return nil, 404
+			}
+			old := txUserSnapshot(user)
+			if status = storeUserDelete(id); status != 200 {
+				return nil, status
+			}
+			return func() {
+				indexUser.Add(&old)
+				indexUser.Get(id).Version = old.Version
+			}, 200
+		}
+
+	case txOpEntityLocation:
+		switch op.kind {
+		case txOpCreate:
+			if !indexLocation.Add(&op.location) {
+				return nil, 400
+			}
+			return func() { indexLocation.Delete(id) }, 200
+
+		case txOpUpdate:
+			location := indexLocation.Get(id)
+			if location == nil {
+				return nil, 404
+			}
+			old := txLocationSnapshot(location)
+			location.Update(&op.location)
+			return func() {
+				location.Update(&old)
+				location.Version = old.Version
+			}, 200
+
+		case txOpDelete:
+			location := indexLocation.Get(id)
+			if location == nil {
+				return nil, 404
+			}
+			old := txLocationSnapshot(location)
+			if status = storeLocationDelete(id); status != 200 {
+				return nil, status
+			}
+			return func() {
+				indexLocation.Add(&old)
+				indexLocation.Get(id).Version = old.Version
+			}, 200
+		}
+
+	case txOpEntityVisit:
+		switch op.kind {
+		case txOpCreate:
+			if status = storeVisitNew(&op.visit); status != 200 {
+				return nil, status
+			}
+			return func() { storeVisitDelete(id) }, 200
+
+		case txOpUpdate:
+			visit := indexVisit.Get(id)
+			if visit == nil {
+				return nil, 404
+			}
+			old := *visit
+			old.Id = 0
+			old.markSetted = true
+			if status = storeVisitUpdate(id, &op.visit); status != 200 {
+				return nil, status
+			}
+			return func() {
+				storeVisitUpdate(id, &old)
+				visit.Version = old.Version
+			}, 200
+
+		case txOpDelete:
+			visit := indexVisit.Get(id)
+			if visit == nil {
+				return nil, 404
+			}
+			old := *visit
+			if status = storeVisitDelete(id); status != 200 {
+				return nil, status
+			}
+			return func() {
+				storeVisitNew(&old)
+				indexVisit.Get(id).Version = old.Version
+			}, 200
+		}
+	}
+
+	// txParse других операций не создает. уже примененное откатит txApply
+	panic(`Bug in code: unexpected tx op`)
+}
+
+// копия пользователя, пригодная и для User.Update (откат обновления), и для IndexUser.Add (откат удаления)
+func txUserSnapshot(user *User) User {
+	// User.Update заменяет срезы целиком, так что копировать их содержимое не нужно
+	return User{
+		Id:              user.Id,
+		Email:           user.Email,
+		FirstName:       user.FirstName,
+		LastName:        user.LastName,
+		Gender:          user.Gender,
+		BirthDate:       user.BirthDate,
+		Version:         user.Version,
+		birthdateSetted: true,
+	}
+}
+
+func txLocationSnapshot(location *Location) Location {
+	// а вот Location.Update пишет Place и City поверх старых, поэтому их надо копировать
+	return Location{
+		Id:         location.Id,
+		Place:      append([]byte{}, location.Place...),
+		CountryIdx: location.CountryIdx,
+		City:       append([]byte{}, location.City...),
+		Distance:   location.Distance,
+		Version:    location.Version,
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"testing"
+)
+
+// пользователь и место для тестов tx. удаляются в cleanup
+func txTestEntities(t *testing.T, userId, locationId int32) {
+	user := User{Id: userId, Email: []byte(`a@b.c`), FirstName: []byte(`A`), LastName: []byte(`B`), Gender: 'm'}
+	if !indexUser.Add(&user) {
+		t.Fatalf(`add user %d fail`, userId)
+	}
+	location := Location{Id: locationId, Place: []byte(`P`), City: []byte(`C`), Distance: 1}
+	if !indexLocation.Add(&location) {
+		t.Fatalf(`add location %d fail`, locationId)
+	}
+
+	t.Cleanup(func() {
+		indexUser.Delete(userId)
+		indexLocation.Delete(locationId)
+	})
+}
+
+func TestTxParse(t *testing.T) {
+	tests := []struct {
+		body     string
+		ok       bool
+		failedOp int
+	}{
+		{body: `{`, failedOp: -1},
+		{body: `{"ops":[]}`, failedOp: -1},
+		{body: `{"ops":[{"op":"delete","entity":"users","id":1}]}`, ok: true, failedOp: -1},
+		{body: `{"ops":[{"op":"delete","entity":"users","id":1},{"op":"drop","entity":"users","id":1}]}`, failedOp: 1},
+		{body: `{"ops":[{"op":"delete","entity":"cats","id":1}]}`, failedOp: 0},
+		{body: `{"ops":[{"op":"delete","entity":"users","id":4294967297}]}`, failedOp: 0},
+		{body: `{"ops":[{"op":"delete","entity":"users","id":1,"data":{}}]}`, failedOp: 0},
+		{body: `{"ops":[{"op":"update","entity":"users","id":1,"data":{"first_name":"X"},"if_match":"\"x\""}]}`, ok: true, failedOp: -1},
+		{body: `{"ops":[{"op":"create","entity":"locations","data":{"id":5,"place":"p","country":"c","city":"c","distance":1},"if_match":"*"}]}`, failedOp: 0},
+	}
+
+	for _, test := range tests {
+		ops, failedOp := txParse([]byte(test.body))
+		if ((ops != nil) != test.ok) || (failedOp != test.failedOp) {
+			t.Errorf(`txParse(%s) = %v, %d; want ok=%v, %d`, test.body, ops != nil, failedOp, test.ok, test.failedOp)
+		}
+	}
+}
+
+func TestTxRollback(t *testing.T) {
+	txTestEntities(t, 901, 901)
+	etag := string(appendETag(nil, indexUser.Get(901).Version))
+
+	tests := []struct {
+		name     string
+		body     string
+		status   int
+		failedOp int
+	}{
+		{
+			name:     `missing entity`,
+			body:     `{"ops":[{"op":"update","entity":"users","id":901,"data":{"first_name":"X"}},{"op":"delete","entity":"users","id":999}]}`,
+			status:   404,
+			failedOp: 1,
+		},
+		{
+			name:     `if_match mismatch`,
+			body:     `{"ops":[{"op":"update","entity":"users","id":901,"data":{"first_name":"X"}},{"op":"update","entity":"locations","id":901,"data":{"distance":7},"if_match":"\"old\""}]}`,
+			status:   412,
+			failedOp: 1,
+		},
+		{
+			name:     `weak if_match`,
+			body:     `{"ops":[{"op":"update","entity":"users","id":901,"data":{"first_name":"X"},"if_match":"W/` + escapeQuotes(etag) + `"}]}`,
+			status:   412,
+			failedOp: 0,
+		},
+	}
+
+	for _, test := range tests {
+		version := indexUser.Get(901).Version
+
+		ops, _ := txParse([]byte(test.body))
+		if ops == nil {
+			t.Fatalf(`%s: parse fail`, test.name)
+		}
+		failedOp, status := txApplyLocked(ops)
+		if (status != test.status) || (failedOp != test.failedOp) {
+			t.Errorf(`%s: %d, %d; want %d, %d`, test.name, status, failedOp, test.status, test.failedOp)
+		}
+
+		if user := indexUser.Get(901); (string(user.FirstName) != `A`) || (user.Version != version) {
+			t.Errorf(`%s: user not rolled back: %s %d`, test.name, user.FirstName, user.Version)
+		}
+		if location := indexLocation.Get(901); location.Distance != 1 {
+			t.Errorf(`%s: location not rolled back: %d`, test.name, location.Distance)
+		}
+	}
+
+	// строгий ETag подходит
+	ops, _ := txParse([]byte(`{"ops":[{"op":"update","entity":"users","id":901,"data":{"first_name":"Y"},"if_match":"` + escapeQuotes(etag) + `"}]}`))
+	if _, status := txApplyLocked(ops); status != 200 {
+		t.Errorf(`matching if_match: %d`, status)
+	}
+}
+
+func TestTxRollbackOnPanic(t *testing.T) {
+	txTestEntities(t, 902, 902)
+
+	ops, _ := txParse([]byte(`{"ops":[
+		{"op":"update","entity":"users","id":902,"data":{"first_name":"X"}},
+		{"op":"create","entity":"users","data":{"id":903,"email":"x@y.z","first_name":"X","last_name":"Y","gender":"f","birth_date":0}},
+		{"op":"delete","entity":"locations","id":902}
+	]}`))
+	if ops == nil {
+		t.Fatal(`parse fail`)
+	}
+	// такую операцию txParse не создаст, txApplyOp на ней падает
+	ops[2].kind = -1
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error(`panic was swallowed`)
+			}
+		}()
+		txApplyLocked(ops)
+	}()
+
+	if user := indexUser.Get(902); string(user.FirstName) != `A` {
+		t.Errorf(`update not rolled back: %s`, user.FirstName)
+	}
+	if indexUser.Get(903) != nil {
+		indexUser.Delete(903)
+		t.Error(`create not rolled back`)
+	}
+	if indexLocation.Get(902) == nil {
+		t.Error(`location deleted`)
+	}
+}
+
+func escapeQuotes(s string) string {
+	buf := make([]byte, 0, len(s)+4)
+	for i := 0; i < len(s); i++ {
+		if s[i] == '"' {
+			buf = append(buf, '\\')
+		}
+		buf = append(buf, s[i])
+	}
+	return string(buf)
+}
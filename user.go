@@ -14,6 +14,7 @@ type (
 		LastName  []byte
 		Gender    byte
 		BirthDate int64
+		Version   uint64 // растет при каждом изменении, отдается как ETag
 
 		birthdateSetted bool
 
@@ -147,6 +148,8 @@ func (u *User) Update(update *User) bool {
 		u.cacheUpdateBirthdate()
 	}
 
+	u.Version = dbNextVersion()
+
 	return true
 }
 
@@ -181,3 +184,11 @@ func (u *User) cacheUpdateGender() {
 		}
 	}
 }
+
+func (u *User) entityId() int32 {
+	return u.Id
+}
+
+func (u *User) setVersion(version uint64) {
+	u.Version = version
+}
@@ -77,7 +77,7 @@ func (uv *UserVisits) Add(location *Location, visit *Visit) bool {
 	return true
 }
 
-func (uv *UserVisits) MoveByVisitId(target *User, visitId int32) bool {
+func (uv *UserVisits) RemoveByVisitId(visitId int32) (item UserVisit, ok bool) {
 	currentPos := -1
 	for i, uvItem := range uv.visits {
 		if uvItem.visitId == visitId {
@@ -86,18 +86,27 @@ func (uv *UserVisits) MoveByVisitId(target *User, visitId int32) bool {
 		}
 	}
 	if currentPos == -1 {
-		return false
+		return item, false
 	}
 
-	bak := uv.visits[currentPos]
+	item = uv.visits[currentPos]
 
-	// удаляем из себя
 	l := len(uv.visits)
 	if currentPos < l-1 {
 		copy(uv.visits[currentPos:], uv.visits[currentPos+1:])
 	}
 	uv.visits = uv.visits[:l-1]
 
+	return item, true
+}
+
+func (uv *UserVisits) MoveByVisitId(target *User, visitId int32) bool {
+	// удаляем из себя
+	bak, ok := uv.RemoveByVisitId(visitId)
+	if !ok {
+		return false
+	}
+
 	// добавляем в новый список
 	idx := target.cache.allocSpaceByVisitedAt(bak.visitedAt)
 	target.cache.visits[idx] = bak
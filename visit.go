@@ -18,6 +18,7 @@ type (
 		User       int32
 		VisitedAt  int32
 		Mark       uint8
+		Version    uint64 // растет при каждом изменении, отдается как ETag
 		markSetted bool
 	}
 )
@@ -150,6 +151,8 @@ func (v *Visit) Update(update *Visit) bool {
 		v.cacheUpdateMark()
 	}
 
+	v.Version = dbNextVersion()
+
 	return true
 }
 
@@ -231,3 +234,11 @@ func (v *Visit) cacheUpdateMark() {
 		}
 	}
 }
+
+func (v *Visit) entityId() int32 {
+	return v.Id
+}
+
+func (v *Visit) setVersion(version uint64) {
+	v.Version = version
+}